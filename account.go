@@ -0,0 +1,132 @@
+package localcert
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ACMEAccount is the stored form of an ACME account, kept in a Cache under
+// CacheKeyACMEAccount. The account URL is stored as PrivateKey.KeyID.
+type ACMEAccount struct {
+	DirectoryURL  string           `json:"directoryURL"`
+	PrivateKey    *jose.JSONWebKey `json:"privateKey"`
+	AcceptedTerms string           `json:"acceptedTerms"`
+
+	// CertificateKeyType is the certificate key type chosen with the CLI's
+	// -keyType flag, used for later renewals.
+	CertificateKeyType KeyType `json:"certificateKeyType,omitempty"`
+
+	// ExternalAccountBinding is used to register the account, and kept to
+	// register a new account if this one is replaced.
+	ExternalAccountBinding *ExternalAccountBinding `json:"externalAccountBinding,omitempty"`
+}
+
+// ExternalAccountBinding binds a new ACME account to an account with the
+// CA, for CAs that require it, e.g. ZeroSSL, Google Trust Services or
+// step-ca. See RFC 8555 section 7.3.4.
+type ExternalAccountBinding struct {
+	// KeyID identifies the account with the CA.
+	KeyID string `json:"keyID"`
+
+	// HMACKey is the MAC key as issued by the CA, base64url-encoded.
+	HMACKey string `json:"hmacKey"`
+}
+
+// acme returns the binding for acme.Account.
+func (b *ExternalAccountBinding) acme() (*acme.ExternalAccountBinding, error) {
+	if b.KeyID == "" || b.HMACKey == "" {
+		return nil, errors.New("external account binding requires a key ID and HMAC key")
+	}
+	// Accept padded and standard base64 too, as some CAs issue it.
+	encoded := strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(b.HMACKey, "="))
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("external account binding HMAC key: %w", err)
+	}
+	return &acme.ExternalAccountBinding{KID: b.KeyID, Key: key}, nil
+}
+
+// ParseACMEAccount decodes a stored ACMEAccount.
+func ParseACMEAccount(data []byte) (*ACMEAccount, error) {
+	account := &ACMEAccount{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, err
+	}
+	if account.PrivateKey == nil {
+		return nil, fmt.Errorf("missing privateKey")
+	}
+	if _, ok := account.PrivateKey.Key.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("invalid privateKey type %T", account.PrivateKey.Key)
+	}
+	return account, nil
+}
+
+// Signer returns the account private key.
+func (a *ACMEAccount) Signer() crypto.Signer {
+	return a.PrivateKey.Key.(crypto.Signer)
+}
+
+// Marshal encodes the account for storage.
+func (a *ACMEAccount) Marshal() ([]byte, error) {
+	return json.MarshalIndent(a, "", "  ")
+}
+
+// GetAccount returns the ACME account for the Client's key.
+func (c *Client) GetAccount(ctx context.Context) (*acme.Account, error) {
+	account, err := c.acmeClient.GetReg(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	c.setAccountURL(account.URI)
+	return account, nil
+}
+
+// RolloverAccountKey replaces the ACME account key with newKey. The account
+// URL, and so the localcert domain, stays the same. The Client keeps using
+// the old key, so callers should use a new Client with newKey afterwards.
+// See RFC 8555 section 7.3.5.
+func (c *Client) RolloverAccountKey(ctx context.Context, newKey crypto.Signer) error {
+	dir, err := c.acmeClient.Discover(ctx)
+	if err != nil {
+		return fmt.Errorf("discover: %w", err)
+	}
+	if dir.KeyChangeURL == "" {
+		return errors.New("ACME server does not support account key rollover")
+	}
+	accountURL, err := c.getAccountURL(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := c.signer(dir, accountURL).SignKeyChange(ctx, dir.KeyChangeURL, newKey)
+	if err != nil {
+		return fmt.Errorf("key change request: %w", err)
+	}
+	resp, err := c.acmePost(ctx, dir.KeyChangeURL, body)
+	if err != nil {
+		return fmt.Errorf("key change: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeactivateAccount permanently deactivates the ACME account. Its key can't
+// be used again and its localcert domain can no longer be provisioned.
+func (c *Client) DeactivateAccount(ctx context.Context) error {
+	// DeactivateReg doesn't discover the directory itself.
+	if _, err := c.acmeClient.Discover(ctx); err != nil {
+		return fmt.Errorf("discover: %w", err)
+	}
+	if err := c.acmeClient.DeactivateReg(ctx); err != nil {
+		return fmt.Errorf("deactivate account: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,1129 @@
+// Package acmetest provides an in-process ACME CA and localcert server for
+// tests, so the localcert client and CLI can be exercised end to end
+// without Let's Encrypt or api.localcert.dev.
+//
+//	srv := acmetest.NewServer(acmetest.ServerConfig{})
+//	defer srv.Close()
+//	client := srv.ClientConfig(accountKey).Client()
+//
+// The CLI can be pointed at the same servers with
+// -acmeUrl srv.CA.DirectoryURL() and -serverUrl srv.URL.
+package acmetest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/internal/acmeutil"
+)
+
+const (
+	defaultCertificateLifetime = 90 * 24 * time.Hour
+	renewalInfoRetryAfter      = 6 * time.Hour
+
+	maxRequestSize = 64 * 1024
+
+	problemAccountDoesNotExist     = "urn:ietf:params:acme:error:accountDoesNotExist"
+	problemAlreadyReplaced         = "urn:ietf:params:acme:error:alreadyReplaced"
+	problemAlreadyRevoked          = "urn:ietf:params:acme:error:alreadyRevoked"
+	problemBadCSR                  = "urn:ietf:params:acme:error:badCSR"
+	problemBadNonce                = "urn:ietf:params:acme:error:badNonce"
+	problemBadRevocationReason     = "urn:ietf:params:acme:error:badRevocationReason"
+	problemConflict                = "urn:ietf:params:acme:error:conflict"
+	problemExternalAccountRequired = "urn:ietf:params:acme:error:externalAccountRequired"
+	problemIncorrectResponse       = "urn:ietf:params:acme:error:incorrectResponse"
+	problemMalformed               = "urn:ietf:params:acme:error:malformed"
+	problemOrderNotReady           = "urn:ietf:params:acme:error:orderNotReady"
+	problemRejectedIdentifier      = "urn:ietf:params:acme:error:rejectedIdentifier"
+	problemUnauthorized            = "urn:ietf:params:acme:error:unauthorized"
+	problemUserActionRequired      = "urn:ietf:params:acme:error:userActionRequired"
+)
+
+// Config configures a CA.
+type Config struct {
+	// TermsOfService is the directory's terms of service URL. If set, new
+	// accounts must agree to the terms.
+	TermsOfService string
+
+	// LookupTXT returns the TXT records for a name, to validate dns-01
+	// challenges. If nil, challenges are valid without a record.
+	LookupTXT func(name string) []string
+
+	// CertificateLifetime is the validity period of issued certificates. If
+	// zero, certificates are valid for 90 days.
+	CertificateLifetime time.Duration
+
+	// DisableRenewalInfo omits renewalInfo (ARI) from the directory.
+	DisableRenewalInfo bool
+
+	// ExternalAccountKeys are external account MAC keys by key ID. If set,
+	// new accounts require an external account binding signed with one of
+	// them.
+	ExternalAccountKeys map[string][]byte
+}
+
+// CA is a minimal ACME CA (RFC 8555) that validates dns-01 challenges and
+// issues certificates from a throwaway root via an intermediate. It
+// supports account key rollover and deactivation and certificate
+// revocation, and serves renewal information (RFC 9773). A CA is safe for
+// concurrent use.
+type CA struct {
+	config Config
+	srv    *httptest.Server
+
+	root             *x509.Certificate
+	intermediate     *x509.Certificate
+	intermediateKey  crypto.Signer
+	intermediatePEMs []byte
+
+	mu             sync.Mutex
+	nonces         map[string]bool
+	accounts       map[string]*account // by ID
+	orders         map[string]*order
+	authzs         map[string]*authorization
+	challenges     map[string]*authorization // by challenge ID
+	certs          map[string]*issuedCert    // by cert ID
+	issued         []*x509.Certificate
+	renewalWindows map[string]localcert.RenewalWindow // by ARI cert ID
+}
+
+type account struct {
+	id         string
+	key        *jose.JSONWebKey
+	thumbprint string
+	status     string
+}
+
+type order struct {
+	id          string
+	accountID   string
+	identifiers []identifier
+	authzIDs    []string
+	status      string // "" while pending or ready, then "valid" or "invalid"
+	certID      string
+}
+
+type authorization struct {
+	id         string
+	accountID  string
+	identifier identifier
+	wildcard   bool
+	token      string
+	status     string
+	chalStatus string
+	chalError  *problem
+}
+
+type issuedCert struct {
+	accountID        string
+	chainPEM         []byte
+	leaf             *x509.Certificate
+	replaced         bool
+	revoked          bool
+	revocationReason acme.CRLReasonCode
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	status int
+}
+
+func (p *problem) Error() string {
+	return p.Type + ": " + p.Detail
+}
+
+// NewCA starts a CA on a local HTTP listener. Callers should call Close
+// when done.
+func NewCA(config Config) *CA {
+	if config.CertificateLifetime == 0 {
+		config.CertificateLifetime = defaultCertificateLifetime
+	}
+	ca := &CA{
+		config:         config,
+		nonces:         make(map[string]bool),
+		accounts:       make(map[string]*account),
+		orders:         make(map[string]*order),
+		authzs:         make(map[string]*authorization),
+		challenges:     make(map[string]*authorization),
+		certs:          make(map[string]*issuedCert),
+		renewalWindows: make(map[string]localcert.RenewalWindow),
+	}
+	if err := ca.generateRoot(); err != nil {
+		panic(fmt.Sprintf("acmetest: generate root: %v", err))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", ca.handleDirectory)
+	mux.HandleFunc("/new-nonce", ca.handleNewNonce)
+	mux.HandleFunc("/new-account", ca.handleNewAccount)
+	mux.HandleFunc("/account/", ca.handleAccount)
+	mux.HandleFunc("/key-change", ca.handleKeyChange)
+	mux.HandleFunc("/new-order", ca.handleNewOrder)
+	mux.HandleFunc("/order/", ca.handleOrder)
+	mux.HandleFunc("/authz/", ca.handleAuthorization)
+	mux.HandleFunc("/challenge/", ca.handleChallenge)
+	mux.HandleFunc("/cert/", ca.handleCertificate)
+	mux.HandleFunc("/revoke-cert", ca.handleRevokeCert)
+	mux.HandleFunc("/renewal-info/", ca.handleRenewalInfo)
+	ca.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every response carries a fresh nonce, including errors, so
+		// clients can retry badNonce errors.
+		ca.setNonce(w)
+		mux.ServeHTTP(w, r)
+	}))
+	return ca
+}
+
+// Close shuts down the CA's listener.
+func (ca *CA) Close() {
+	ca.srv.Close()
+}
+
+// DirectoryURL returns the ACME directory URL.
+func (ca *CA) DirectoryURL() string {
+	return ca.srv.URL + "/directory"
+}
+
+// Root returns the root certificate that issued certificates chain to.
+func (ca *CA) Root() *x509.Certificate {
+	return ca.root
+}
+
+// Roots returns a pool containing Root, for verifying issued certificates.
+func (ca *CA) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.root)
+	return pool
+}
+
+// Issued returns the leaf certificates issued so far, oldest first.
+func (ca *CA) Issued() []*x509.Certificate {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return append([]*x509.Certificate(nil), ca.issued...)
+}
+
+// Replaced reports whether a new order marked cert as replaced (RFC 9773).
+func (ca *CA) Replaced(cert *x509.Certificate) bool {
+	certID, err := localcert.CertID(cert)
+	if err != nil {
+		return false
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued := ca.certs[certID]
+	return issued != nil && issued.replaced
+}
+
+// Revoked reports whether cert was revoked, and why.
+func (ca *CA) Revoked(cert *x509.Certificate) (reason acme.CRLReasonCode, revoked bool) {
+	certID, err := localcert.CertID(cert)
+	if err != nil {
+		return 0, false
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued := ca.certs[certID]
+	if issued == nil || !issued.revoked {
+		return 0, false
+	}
+	return issued.revocationReason, true
+}
+
+// SetRenewalWindow overrides the suggested renewal window for cert, e.g.
+// to simulate a CA asking for early renewal after an incident.
+func (ca *CA) SetRenewalWindow(cert *x509.Certificate, window localcert.RenewalWindow) error {
+	certID, err := localcert.CertID(cert)
+	if err != nil {
+		return err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.renewalWindows[certID] = window
+	return nil
+}
+
+func (ca *CA) generateRoot() error {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	ca.root, err = x509.ParseCertificate(rootDER)
+	if err != nil {
+		return err
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	intermediateTmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "acmetest intermediate"},
+		NotBefore:             notBefore,
+		NotAfter:              rootTmpl.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, intermediateTmpl, ca.root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	ca.intermediate, err = x509.ParseCertificate(intermediateDER)
+	if err != nil {
+		return err
+	}
+	ca.intermediateKey = intermediateKey
+	ca.intermediatePEMs = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediateDER})
+	return nil
+}
+
+func (ca *CA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *CA) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	dir := map[string]interface{}{
+		"newNonce":   ca.url("/new-nonce"),
+		"newAccount": ca.url("/new-account"),
+		"newOrder":   ca.url("/new-order"),
+		"keyChange":  ca.url("/key-change"),
+		"revokeCert": ca.url("/revoke-cert"),
+	}
+	if !ca.config.DisableRenewalInfo {
+		dir["renewalInfo"] = ca.url("/renewal-info/")
+	}
+	meta := map[string]interface{}{}
+	if ca.config.TermsOfService != "" {
+		meta["termsOfService"] = ca.config.TermsOfService
+	}
+	if len(ca.config.ExternalAccountKeys) > 0 {
+		meta["externalAccountRequired"] = true
+	}
+	if len(meta) > 0 {
+		dir["meta"] = meta
+	}
+	writeJSON(w, http.StatusOK, dir)
+}
+
+func (ca *CA) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ca *CA) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, payload, ok := ca.verifyRequest(w, r, true)
+	if !ok {
+		return
+	}
+	var newAccount struct {
+		TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+		ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+	}
+	if err := json.Unmarshal(payload, &newAccount); err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid newAccount payload: %v", err))
+		return
+	}
+	thumbprint, err := jwkThumbprint(req.JWK)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid JWK: %v", err))
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for _, acct := range ca.accounts {
+		if acct.thumbprint == thumbprint {
+			ca.writeAccount(w, http.StatusOK, acct)
+			return
+		}
+	}
+	if newAccount.OnlyReturnExisting {
+		ca.writeProblem(w, http.StatusBadRequest, problemAccountDoesNotExist, "no account for key")
+		return
+	}
+	if ca.config.TermsOfService != "" && !newAccount.TermsOfServiceAgreed {
+		ca.writeProblem(w, http.StatusForbidden, problemUserActionRequired, "must agree to terms of service "+ca.config.TermsOfService)
+		return
+	}
+	if len(ca.config.ExternalAccountKeys) > 0 {
+		if p := ca.checkExternalAccountBinding(newAccount.ExternalAccountBinding, req.URL, thumbprint); p != nil {
+			ca.writeProblem(w, p.status, p.Type, p.Detail)
+			return
+		}
+	}
+	acct := &account{id: randomID(), key: req.JWK, thumbprint: thumbprint, status: "valid"}
+	ca.accounts[acct.id] = acct
+	ca.writeAccount(w, http.StatusCreated, acct)
+}
+
+// checkExternalAccountBinding checks that a newAccount request's external
+// account binding is a JWS of the account key, MACed with a known key for
+// the newAccount URL. See RFC 8555 section 7.3.4.
+func (ca *CA) checkExternalAccountBinding(eab json.RawMessage, url, thumbprint string) *problem {
+	if len(eab) == 0 {
+		return &problem{Type: problemExternalAccountRequired, Detail: "external account binding required", status: http.StatusUnauthorized}
+	}
+	binding, err := acmeutil.ParseSignedRequest(eab)
+	if err != nil {
+		return &problem{Type: problemMalformed, Detail: fmt.Sprintf("invalid external account binding: %v", err), status: http.StatusBadRequest}
+	}
+	key, ok := ca.config.ExternalAccountKeys[binding.KID]
+	if !ok {
+		return &problem{Type: problemUnauthorized, Detail: fmt.Sprintf("unknown external account %q", binding.KID), status: http.StatusUnauthorized}
+	}
+	if err := binding.Verify(key); err != nil {
+		return &problem{Type: problemUnauthorized, Detail: fmt.Sprintf("invalid external account binding MAC: %v", err), status: http.StatusUnauthorized}
+	}
+	if binding.URL != url {
+		return &problem{Type: problemMalformed, Detail: "external account binding url doesn't match request URL", status: http.StatusBadRequest}
+	}
+	var boundKey jose.JSONWebKey
+	if err := json.Unmarshal(binding.UnsafePayload(), &boundKey); err != nil {
+		return &problem{Type: problemMalformed, Detail: fmt.Sprintf("invalid external account binding key: %v", err), status: http.StatusBadRequest}
+	}
+	if boundThumbprint, err := jwkThumbprint(&boundKey); err != nil || boundThumbprint != thumbprint {
+		return &problem{Type: problemUnauthorized, Detail: "external account binding key doesn't match the account key", status: http.StatusUnauthorized}
+	}
+	return nil
+}
+
+func (ca *CA) handleAccount(w http.ResponseWriter, r *http.Request) {
+	_, acct, payload, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Path != "/account/"+acct.id {
+		ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, "account URL doesn't match KID")
+		return
+	}
+	var update struct {
+		Status string `json:"status"`
+	}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &update); err != nil {
+			ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid account payload: %v", err))
+			return
+		}
+	}
+	switch update.Status {
+	case "":
+	case "deactivated":
+		// Deactivation is permanent; verifyAccountRequest rejects any
+		// later requests.
+		ca.mu.Lock()
+		acct.status = update.Status
+		ca.mu.Unlock()
+	default:
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("can't change account status to %q", update.Status))
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.writeAccount(w, http.StatusOK, acct)
+}
+
+// handleKeyChange replaces an account's key. The request payload is a JWS
+// signed by the new key, with the account URL and old key as its payload.
+// See RFC 8555 section 7.3.5.
+func (ca *CA) handleKeyChange(w http.ResponseWriter, r *http.Request) {
+	outer, acct, payload, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	inner, err := acmeutil.ParseSignedRequest(payload)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid inner JWS: %v", err))
+		return
+	}
+	if inner.JWK == nil || inner.KID != "" || inner.Nonce != "" {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "inner JWS must have an embedded JWK and no nonce")
+		return
+	}
+	if inner.URL != outer.URL {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("inner JWS url %q doesn't match outer url", inner.URL))
+		return
+	}
+	if err := inner.Verify(inner.JWK.Key); err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid inner JWS signature: %v", err))
+		return
+	}
+	var keyChange struct {
+		Account string          `json:"account"`
+		OldKey  jose.JSONWebKey `json:"oldKey"`
+	}
+	if err := json.Unmarshal(inner.UnsafePayload(), &keyChange); err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid keyChange payload: %v", err))
+		return
+	}
+	if keyChange.Account != outer.KID {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "keyChange account doesn't match KID")
+		return
+	}
+	oldThumbprint, err := jwkThumbprint(&keyChange.OldKey)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid oldKey: %v", err))
+		return
+	}
+	newThumbprint, err := jwkThumbprint(inner.JWK)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid JWK: %v", err))
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if oldThumbprint != acct.thumbprint {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "oldKey doesn't match the account key")
+		return
+	}
+	for _, other := range ca.accounts {
+		if other.thumbprint == newThumbprint {
+			w.Header().Set("Location", ca.url("/account/"+other.id))
+			ca.writeProblem(w, http.StatusConflict, problemConflict, "new key is already in use by an account")
+			return
+		}
+	}
+	acct.key = inner.JWK
+	acct.thumbprint = newThumbprint
+	ca.writeAccount(w, http.StatusOK, acct)
+}
+
+// writeAccount writes an account response. Callers must hold mu.
+func (ca *CA) writeAccount(w http.ResponseWriter, status int, acct *account) {
+	w.Header().Set("Location", ca.url("/account/"+acct.id))
+	writeJSON(w, status, map[string]interface{}{
+		"status": acct.status,
+		"key":    acct.key,
+		"orders": ca.url("/account/" + acct.id + "/orders"),
+	})
+}
+
+func (ca *CA) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	_, acct, payload, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	var newOrder struct {
+		Identifiers []identifier `json:"identifiers"`
+		Replaces    string       `json:"replaces"`
+	}
+	if err := json.Unmarshal(payload, &newOrder); err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid newOrder payload: %v", err))
+		return
+	}
+	if len(newOrder.Identifiers) == 0 {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "order has no identifiers")
+		return
+	}
+	for _, id := range newOrder.Identifiers {
+		if id.Type != "dns" || strings.TrimPrefix(id.Value, "*.") == "" || strings.Contains(strings.TrimPrefix(id.Value, "*."), "*") {
+			ca.writeProblem(w, http.StatusBadRequest, problemRejectedIdentifier, fmt.Sprintf("unsupported identifier %q", id.Value))
+			return
+		}
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if newOrder.Replaces != "" {
+		if p := ca.checkReplaces(acct, newOrder.Replaces, newOrder.Identifiers); p != nil {
+			ca.writeProblem(w, p.status, p.Type, p.Detail)
+			return
+		}
+		ca.certs[newOrder.Replaces].replaced = true
+	}
+	o := &order{id: randomID(), accountID: acct.id, identifiers: newOrder.Identifiers}
+	for _, id := range newOrder.Identifiers {
+		authz := &authorization{
+			id:         randomID(),
+			accountID:  acct.id,
+			identifier: identifier{Type: "dns", Value: strings.TrimPrefix(id.Value, "*.")},
+			wildcard:   strings.HasPrefix(id.Value, "*."),
+			token:      randomID(),
+			status:     "pending",
+			chalStatus: "pending",
+		}
+		ca.authzs[authz.id] = authz
+		ca.challenges[authz.id] = authz
+		o.authzIDs = append(o.authzIDs, authz.id)
+	}
+	ca.orders[o.id] = o
+	ca.writeOrder(w, http.StatusCreated, o)
+}
+
+// checkReplaces checks an order's ARI replaces field. Callers must hold mu.
+func (ca *CA) checkReplaces(acct *account, certID string, ids []identifier) *problem {
+	issued := ca.certs[certID]
+	if issued == nil {
+		return &problem{Type: problemMalformed, Detail: fmt.Sprintf("unknown certificate %q", certID), status: http.StatusBadRequest}
+	}
+	if issued.accountID != acct.id {
+		return &problem{Type: problemUnauthorized, Detail: "certificate was issued to another account", status: http.StatusForbidden}
+	}
+	if issued.replaced {
+		return &problem{Type: problemAlreadyReplaced, Detail: fmt.Sprintf("certificate %q was already replaced", certID), status: http.StatusConflict}
+	}
+	for _, id := range ids {
+		for _, name := range issued.leaf.DNSNames {
+			if id.Value == name {
+				return nil
+			}
+		}
+	}
+	return &problem{Type: problemMalformed, Detail: "order shares no identifiers with the replaced certificate", status: http.StatusBadRequest}
+}
+
+func (ca *CA) handleOrder(w http.ResponseWriter, r *http.Request) {
+	_, acct, payload, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/order/")
+	finalize := strings.HasSuffix(id, "/finalize")
+	id = strings.TrimSuffix(id, "/finalize")
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	o := ca.orders[id]
+	if o == nil || o.accountID != acct.id {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such order")
+		return
+	}
+	if finalize {
+		if p := ca.finalize(o, payload); p != nil {
+			ca.writeProblem(w, p.status, p.Type, p.Detail)
+			return
+		}
+	}
+	ca.writeOrder(w, http.StatusOK, o)
+}
+
+// orderStatus returns the status of o, derived from its authorizations.
+// Callers must hold mu.
+func (ca *CA) orderStatus(o *order) string {
+	if o.status != "" {
+		return o.status
+	}
+	status := "ready"
+	for _, authzID := range o.authzIDs {
+		switch ca.authzs[authzID].status {
+		case "invalid":
+			return "invalid"
+		case "pending":
+			status = "pending"
+		}
+	}
+	return status
+}
+
+// writeOrder writes an order response. Callers must hold mu.
+func (ca *CA) writeOrder(w http.ResponseWriter, status int, o *order) {
+	res := map[string]interface{}{
+		"status":      ca.orderStatus(o),
+		"identifiers": o.identifiers,
+		"finalize":    ca.url("/order/" + o.id + "/finalize"),
+	}
+	var authzURLs []string
+	for _, authzID := range o.authzIDs {
+		authzURLs = append(authzURLs, ca.url("/authz/"+authzID))
+	}
+	res["authorizations"] = authzURLs
+	if o.certID != "" {
+		res["certificate"] = ca.url("/cert/" + o.certID)
+	}
+	w.Header().Set("Location", ca.url("/order/"+o.id))
+	writeJSON(w, status, res)
+}
+
+// finalize issues a certificate for a ready order. Callers must hold mu.
+func (ca *CA) finalize(o *order, payload []byte) *problem {
+	if status := ca.orderStatus(o); status != "ready" {
+		return &problem{Type: problemOrderNotReady, Detail: fmt.Sprintf("order is %s", status), status: http.StatusForbidden}
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return &problem{Type: problemMalformed, Detail: fmt.Sprintf("invalid finalize payload: %v", err), status: http.StatusBadRequest}
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return &problem{Type: problemBadCSR, Detail: fmt.Sprintf("invalid CSR encoding: %v", err), status: http.StatusBadRequest}
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return &problem{Type: problemBadCSR, Detail: fmt.Sprintf("invalid CSR: %v", err), status: http.StatusBadRequest}
+	}
+	if !csrMatchesOrder(csr, o.identifiers) {
+		return &problem{Type: problemBadCSR, Detail: "CSR names don't match the order identifiers", status: http.StatusBadRequest}
+	}
+
+	leaf, err := ca.issue(csr)
+	if err != nil {
+		return &problem{Type: problemMalformed, Detail: fmt.Sprintf("issue certificate: %v", err), status: http.StatusInternalServerError}
+	}
+	certID, err := localcert.CertID(leaf)
+	if err != nil {
+		return &problem{Type: problemMalformed, Detail: err.Error(), status: http.StatusInternalServerError}
+	}
+	chainPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), ca.intermediatePEMs...)
+	ca.certs[certID] = &issuedCert{accountID: o.accountID, chainPEM: chainPEM, leaf: leaf}
+	ca.issued = append(ca.issued, leaf)
+	o.certID = certID
+	o.status = "valid"
+	return nil
+}
+
+func csrMatchesOrder(csr *x509.CertificateRequest, ids []identifier) bool {
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[strings.ToLower(id.Value)] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !want[cn] {
+		return false
+	}
+	if len(csr.DNSNames) != len(want) {
+		return false
+	}
+	for _, name := range csr.DNSNames {
+		if !want[strings.ToLower(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (ca *CA) issue(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	notBefore := time.Now().Add(-time.Minute)
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(ca.config.CertificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.intermediate, csr.PublicKey, ca.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (ca *CA) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	_, acct, _, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	authz := ca.authzs[strings.TrimPrefix(r.URL.Path, "/authz/")]
+	if authz == nil || authz.accountID != acct.id {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such authorization")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"identifier": authz.identifier,
+		"status":     authz.status,
+		"expires":    time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		"wildcard":   authz.wildcard,
+		"challenges": []interface{}{ca.challengeJSON(authz)},
+	})
+}
+
+// challengeJSON returns authz's dns-01 challenge. Callers must hold mu.
+func (ca *CA) challengeJSON(authz *authorization) map[string]interface{} {
+	chal := map[string]interface{}{
+		"type":   "dns-01",
+		"url":    ca.url("/challenge/" + authz.id),
+		"token":  authz.token,
+		"status": authz.chalStatus,
+	}
+	if authz.chalError != nil {
+		chal["error"] = authz.chalError
+	}
+	return chal
+}
+
+func (ca *CA) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	_, acct, payload, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	ca.mu.Lock()
+	authz := ca.challenges[strings.TrimPrefix(r.URL.Path, "/challenge/")]
+	if authz == nil || authz.accountID != acct.id {
+		ca.mu.Unlock()
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such challenge")
+		return
+	}
+	respond := len(payload) > 0 && authz.chalStatus == "pending"
+	token, key := authz.token, acct.key
+	ca.mu.Unlock()
+
+	// A non-empty payload responds to the challenge; POST-as-GET only
+	// fetches it. Validation happens synchronously, outside the lock since
+	// LookupTXT may call back into the localcert server.
+	var validationErr *problem
+	if respond {
+		validationErr = ca.validateDNS01(authz.identifier.Value, token, key)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if respond && authz.chalStatus == "pending" {
+		if validationErr != nil {
+			authz.chalStatus, authz.status, authz.chalError = "invalid", "invalid", validationErr
+		} else {
+			authz.chalStatus, authz.status = "valid", "valid"
+		}
+	}
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"up\"", ca.url("/authz/"+authz.id)))
+	writeJSON(w, http.StatusOK, ca.challengeJSON(authz))
+}
+
+// validateDNS01 checks the dns-01 TXT record for domain. See RFC 8555
+// section 8.4.
+func (ca *CA) validateDNS01(domain, token string, key *jose.JSONWebKey) *problem {
+	if ca.config.LookupTXT == nil {
+		return nil
+	}
+	thumbprint, err := jwkThumbprint(key)
+	if err != nil {
+		return &problem{Type: problemMalformed, Detail: err.Error()}
+	}
+	sum := sha256.Sum256([]byte(token + "." + thumbprint))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+	name := "_acme-challenge." + domain
+	for _, value := range ca.config.LookupTXT(name) {
+		if value == want {
+			return nil
+		}
+	}
+	return &problem{Type: problemIncorrectResponse, Detail: fmt.Sprintf("no TXT record %q found at %s", want, name)}
+}
+
+func (ca *CA) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	_, acct, _, ok := ca.verifyAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued := ca.certs[strings.TrimPrefix(r.URL.Path, "/cert/")]
+	if issued == nil || issued.accountID != acct.id {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such certificate")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(issued.chainPEM)
+}
+
+// handleRevokeCert revokes a certificate. The request is signed either by
+// the account the certificate was issued to or by the certificate's key.
+// See RFC 8555 section 7.6.
+func (ca *CA) handleRevokeCert(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("read request: %v", err))
+		return
+	}
+	req, err := acmeutil.ParseSignedRequest(body)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid JWS: %v", err))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var acct *account
+	var payload []byte
+	var ok bool
+	if req.JWK != nil {
+		_, payload, ok = ca.verifyRequest(w, r, true)
+	} else {
+		_, acct, payload, ok = ca.verifyAccountRequest(w, r)
+	}
+	if !ok {
+		return
+	}
+
+	var revocation struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(payload, &revocation); err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid revokeCert payload: %v", err))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(revocation.Certificate)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid certificate: %v", err))
+		return
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid certificate: %v", err))
+		return
+	}
+	// RFC 5280 reason codes; 7 is unused.
+	if revocation.Reason < 0 || revocation.Reason > int(acme.CRLReasonAACompromise) || revocation.Reason == 7 {
+		ca.writeProblem(w, http.StatusBadRequest, problemBadRevocationReason, fmt.Sprintf("invalid reason %d", revocation.Reason))
+		return
+	}
+	certID, err := localcert.CertID(leaf)
+	if err != nil {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such certificate")
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued := ca.certs[certID]
+	if issued == nil || !bytes.Equal(issued.leaf.Raw, der) {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such certificate")
+		return
+	}
+	if acct != nil && issued.accountID != acct.id {
+		ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, "certificate was issued to another account")
+		return
+	}
+	if acct == nil {
+		certThumbprint, err := jwkThumbprint(&jose.JSONWebKey{Key: leaf.PublicKey})
+		if err != nil {
+			ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid certificate key: %v", err))
+			return
+		}
+		if reqThumbprint, err := jwkThumbprint(req.JWK); err != nil || reqThumbprint != certThumbprint {
+			ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, "request isn't signed by the certificate key")
+			return
+		}
+	}
+	if issued.revoked {
+		ca.writeProblem(w, http.StatusBadRequest, problemAlreadyRevoked, "certificate is already revoked")
+		return
+	}
+	issued.revoked = true
+	issued.revocationReason = acme.CRLReasonCode(revocation.Reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ca *CA) handleRenewalInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		ca.writeProblem(w, http.StatusMethodNotAllowed, problemMalformed, "method must be GET")
+		return
+	}
+	certID := strings.TrimPrefix(r.URL.Path, "/renewal-info/")
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued := ca.certs[certID]
+	if issued == nil {
+		ca.writeProblem(w, http.StatusNotFound, problemMalformed, "no such certificate")
+		return
+	}
+	window, ok := ca.renewalWindows[certID]
+	if !ok && issued.revoked {
+		// Like Let's Encrypt, ask for revoked certificates to be replaced
+		// now.
+		window.Start = time.Now().Add(-time.Hour)
+		window.End = time.Now()
+	} else if !ok {
+		// Like Let's Encrypt, suggest renewing about two thirds of the
+		// way through the certificate's lifetime.
+		lifetime := issued.leaf.NotAfter.Sub(issued.leaf.NotBefore)
+		window.Start = issued.leaf.NotBefore.Add(lifetime * 2 / 3)
+		window.End = issued.leaf.NotBefore.Add(lifetime * 7 / 10)
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(renewalInfoRetryAfter.Seconds())))
+	writeJSON(w, http.StatusOK, localcert.RenewalInfo{SuggestedWindow: window})
+}
+
+// verifyAccountRequest verifies a request signed with an account's KID and
+// returns the account and payload. On failure it writes a problem response.
+func (ca *CA) verifyAccountRequest(w http.ResponseWriter, r *http.Request) (*acmeutil.SignedRequest, *account, []byte, bool) {
+	req, _, ok := ca.verifyRequest(w, r, false)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	// Account keys and status change with key rollover and deactivation.
+	ca.mu.Lock()
+	acct := ca.accounts[strings.TrimPrefix(req.KID, ca.url("/account/"))]
+	var key *jose.JSONWebKey
+	var status string
+	if acct != nil {
+		key, status = acct.key, acct.status
+	}
+	ca.mu.Unlock()
+	if acct == nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemAccountDoesNotExist, fmt.Sprintf("no account %q", req.KID))
+		return nil, nil, nil, false
+	}
+	if err := req.Verify(key.Key); err != nil {
+		ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, fmt.Sprintf("invalid signature: %v", err))
+		return nil, nil, nil, false
+	}
+	if status != "valid" {
+		ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, fmt.Sprintf("account is %s", status))
+		return nil, nil, nil, false
+	}
+	return req, acct, req.UnsafePayload(), true
+}
+
+// verifyRequest parses a signed request and checks its nonce and URL. If
+// embedJWK is true it must embed its key, which the signature is checked
+// against; otherwise it must have a KID, which the caller checks. On
+// failure it writes a problem response.
+func (ca *CA) verifyRequest(w http.ResponseWriter, r *http.Request, embedJWK bool) (*acmeutil.SignedRequest, []byte, bool) {
+	if r.Method != http.MethodPost {
+		ca.writeProblem(w, http.StatusMethodNotAllowed, problemMalformed, "method must be POST")
+		return nil, nil, false
+	}
+	if ct := r.Header.Get("Content-Type"); ct != acmeutil.RequestContentType {
+		ca.writeProblem(w, http.StatusUnsupportedMediaType, problemMalformed, fmt.Sprintf("content type must be %s", acmeutil.RequestContentType))
+		return nil, nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("read request: %v", err))
+		return nil, nil, false
+	}
+	req, err := acmeutil.ParseSignedRequest(body)
+	if err != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid JWS: %v", err))
+		return nil, nil, false
+	}
+	if !ca.useNonce(req.Nonce) {
+		ca.writeProblem(w, http.StatusBadRequest, problemBadNonce, fmt.Sprintf("invalid nonce %q", req.Nonce))
+		return nil, nil, false
+	}
+	if req.URL != ca.url(r.URL.Path) {
+		ca.writeProblem(w, http.StatusBadRequest, problemUnauthorized, fmt.Sprintf("JWS url %q doesn't match request URL", req.URL))
+		return nil, nil, false
+	}
+
+	if embedJWK {
+		if req.JWK == nil || req.KID != "" {
+			ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "request must be signed with an embedded JWK")
+			return nil, nil, false
+		}
+		if err := req.Verify(req.JWK.Key); err != nil {
+			ca.writeProblem(w, http.StatusForbidden, problemUnauthorized, fmt.Sprintf("invalid signature: %v", err))
+			return nil, nil, false
+		}
+		return req, req.UnsafePayload(), true
+	}
+	if req.KID == "" || req.JWK != nil {
+		ca.writeProblem(w, http.StatusBadRequest, problemMalformed, "request must be signed with a KID")
+		return nil, nil, false
+	}
+	return req, nil, true
+}
+
+func (ca *CA) setNonce(w http.ResponseWriter) {
+	nonce := randomID()
+	ca.mu.Lock()
+	ca.nonces[nonce] = true
+	ca.mu.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (ca *CA) useNonce(nonce string) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if !ca.nonces[nonce] {
+		return false
+	}
+	delete(ca.nonces, nonce)
+	return true
+}
+
+func (ca *CA) writeProblem(w http.ResponseWriter, code int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(problem{Type: typ, Detail: detail})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func jwkThumbprint(key *jose.JSONWebKey) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
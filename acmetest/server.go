@@ -0,0 +1,96 @@
+package acmetest
+
+import (
+	"crypto"
+	"net/http/httptest"
+	"time"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/internal/server"
+)
+
+const (
+	// DefaultZone is the parent zone of test domains.
+	DefaultZone = "user.localcert.test"
+
+	recordTTL = time.Hour
+)
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	// CA configures the Server's CA. Its LookupTXT is set to the localcert
+	// server's published records.
+	CA Config
+
+	// Zone is the parent zone of user domains. If empty, DefaultZone is
+	// used.
+	Zone string
+
+	// ACMEDirectoryURLs are other ACME CAs that the localcert server
+	// accepts, e.g. another CA whose LookupTXT is Server.LookupTXT.
+	ACMEDirectoryURLs []string
+}
+
+// Server is a localcert API server (/domain and /provision) backed by a
+// CA. Challenge records published by the localcert server are checked by
+// the CA, so the whole provisioning flow runs in process.
+type Server struct {
+	// CA is the ACME CA that the localcert server forwards requests to.
+	CA *CA
+
+	// URL is the localcert server URL, e.g. for localcert.Config or the
+	// CLI's -serverUrl flag.
+	URL string
+
+	api     *server.Server
+	srv     *httptest.Server
+	records *server.MemoryRecords
+}
+
+// NewServer starts a CA and a localcert server on local HTTP listeners.
+// Callers should call Close when done.
+func NewServer(config ServerConfig) *Server {
+	zone := config.Zone
+	if zone == "" {
+		zone = DefaultZone
+	}
+	records := server.NewMemoryRecords(recordTTL)
+	caConfig := config.CA
+	caConfig.LookupTXT = records.LookupTXT
+	ca := NewCA(caConfig)
+
+	api := server.New(server.Config{
+		Zone:              zone,
+		ACMEDirectoryURL:  ca.DirectoryURL(),
+		ACMEDirectoryURLs: config.ACMEDirectoryURLs,
+		Records:           records,
+	})
+	srv := httptest.NewServer(api)
+	return &Server{CA: ca, URL: srv.URL, api: api, srv: srv, records: records}
+}
+
+// Close shuts down the localcert server and CA.
+func (s *Server) Close() {
+	s.srv.Close()
+	s.CA.Close()
+}
+
+// ClientConfig returns a localcert.Config for the servers using accountKey.
+func (s *Server) ClientConfig(accountKey crypto.Signer) localcert.Config {
+	return localcert.Config{
+		ACMEPrivateKey:     accountKey,
+		ACMEDirectoryURL:   s.CA.DirectoryURL(),
+		LocalCertServerURL: s.URL,
+	}
+}
+
+// Domain returns the wildcard localcert domain assigned to an ACME account
+// URL.
+func (s *Server) Domain(accountURL string) string {
+	return s.api.Domain(accountURL)
+}
+
+// LookupTXT returns the challenge records published for name.
+func (s *Server) LookupTXT(name string) []string {
+	return s.records.LookupTXT(name)
+}
@@ -5,7 +5,10 @@ import (
 )
 
 type DomainRequest struct {
-	AccountRequest []byte `json:"signedAccountRequest"`
+	// ACMEDirectoryURL is the directory of the ACME CA that the account
+	// request is for. If empty, the server's default CA is used.
+	ACMEDirectoryURL string `json:"acmeDirectoryURL,omitempty"`
+	AccountRequest   []byte `json:"signedAccountRequest"`
 }
 
 type DomainResult struct {
@@ -13,6 +16,8 @@ type DomainResult struct {
 }
 
 type ProvisionRequest struct {
+	// ACMEDirectoryURL is as for DomainRequest.
+	ACMEDirectoryURL     string           `json:"acmeDirectoryURL,omitempty"`
 	PublicKey            *jose.JSONWebKey `json:"accountPublicKey"`
 	AuthorizationRequest []byte           `json:"signedAuthorizationRequest"`
 }
@@ -0,0 +1,157 @@
+package localcert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/lann/localcert/internal/fileutil"
+)
+
+// Cache keys used by Manager and the localcert CLI.
+const (
+	CacheKeyACMEAccount    = "acme_account.json"
+	CacheKeyCertificate    = "cert.pem"
+	CacheKeyCertificateKey = "privkey.pem"
+)
+
+// ErrCacheMiss is returned by Cache.Get when there is no data for a key.
+var ErrCacheMiss = errors.New("localcert: cache miss")
+
+// Cache stores ACME account and certificate data. It is compatible with
+// autocert.Cache, except that implementations must return ErrCacheMiss
+// from this package.
+type Cache interface {
+	// Get returns the data for key, or ErrCacheMiss if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put stores data for key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Delete removes the data for key. It is not an error if there is none.
+	Delete(ctx context.Context, key string) error
+}
+
+// DirCache is a Cache that stores each key as a file in a directory, which
+// is created on first Put if necessary.
+type DirCache string
+
+var _ Cache = DirCache("")
+
+func (d DirCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrCacheMiss
+	}
+	return data, err
+}
+
+func (d DirCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(d.path(key), data, 0600)
+}
+
+func (d DirCache) Delete(ctx context.Context, key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d DirCache) path(key string) string {
+	return filepath.Join(string(d), filepath.Clean("/"+key))
+}
+
+// MemCache is a Cache that stores data in memory. The zero value is ready
+// to use.
+type MemCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+var _ Cache = (*MemCache)(nil)
+
+func (m *MemCache) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *MemCache) Put(ctx context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = make(map[string][]byte)
+	}
+	m.data[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *MemCache) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+// ExecCacheMissStatus is the exit status an ExecCache helper uses to report
+// that there is no data for a key.
+const ExecCacheMissStatus = 3
+
+// ExecCache is a Cache that delegates to a helper program, which is run as:
+//
+//	<Command> <Args...> get <key>     # writes data to stdout
+//	<Command> <Args...> put <key>     # reads data from stdin
+//	<Command> <Args...> delete <key>
+//
+// On get, the helper must exit with ExecCacheMissStatus if there is no data
+// for the key. This can be used to keep account keys and certificates in
+// e.g. a secrets manager or Kubernetes Secret.
+type ExecCache struct {
+	Command string
+	Args    []string
+}
+
+var _ Cache = (*ExecCache)(nil)
+
+func (e *ExecCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := e.run(ctx, "get", key, nil)
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) && exitErr.ExitCode() == ExecCacheMissStatus {
+		return nil, ErrCacheMiss
+	}
+	return data, err
+}
+
+func (e *ExecCache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := e.run(ctx, "put", key, data)
+	return err
+}
+
+func (e *ExecCache) Delete(ctx context.Context, key string) error {
+	_, err := e.run(ctx, "delete", key, nil)
+	return err
+}
+
+func (e *ExecCache) run(ctx context.Context, op, key string, stdin []byte) ([]byte, error) {
+	args := append(append([]string(nil), e.Args...), op, key)
+	cmd := exec.CommandContext(ctx, e.Command, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cache helper %s %q: %w", op, key, err)
+	}
+	return out, nil
+}
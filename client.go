@@ -8,9 +8,12 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 
 	"golang.org/x/crypto/acme"
 	"gopkg.in/square/go-jose.v2"
@@ -18,12 +21,24 @@ import (
 	"github.com/lann/localcert/internal/acmeutil"
 )
 
-const defaultUserAgent = "localcert/1.0"
+const (
+	DefaultServerURL = "https://api.localcert.dev"
+
+	defaultUserAgent = "localcert/1.0"
+)
+
+// ErrExternalAccountRequired is returned by EnsureRegistration if the ACME
+// server requires an external account binding and none is configured.
+var ErrExternalAccountRequired = errors.New("localcert: ACME server requires an external account binding")
 
 type Config struct {
 	ACMEPrivateKey   crypto.Signer
 	ACMEDirectoryURL string
 
+	// ExternalAccountBinding is used to register new ACME accounts with CAs
+	// that require it.
+	ExternalAccountBinding *ExternalAccountBinding
+
 	LocalCertServerURL string
 	HTTPClient         *http.Client
 	UserAgentPrefix    string
@@ -40,8 +55,14 @@ func (config Config) Client() *Client {
 		userAgent = defaultUserAgent
 	}
 
+	serverURL := config.LocalCertServerURL
+	if serverURL == "" {
+		serverURL = DefaultServerURL
+	}
+
 	return &Client{
-		serverURL: config.LocalCertServerURL,
+		serverURL: serverURL,
+		eab:       config.ExternalAccountBinding,
 		acmeClient: &acme.Client{
 			Key:          config.ACMEPrivateKey,
 			DirectoryURL: config.ACMEDirectoryURL,
@@ -51,9 +72,19 @@ func (config Config) Client() *Client {
 	}
 }
 
+// Client provisions localcert domains and certificates. A Client is safe
+// for concurrent use.
 type Client struct {
 	serverURL  string
+	eab        *ExternalAccountBinding
 	acmeClient *acme.Client
+
+	accountMu  sync.Mutex
+	accountURL string
+
+	// renewalInfo is the directory's renewalInfo URL, once discovered.
+	directoryMu sync.Mutex
+	renewalInfo *string
 }
 
 func (c *Client) EnsureRegistration(ctx context.Context, acceptedTermsURI string, accountURL string) (*acme.Account, error) {
@@ -66,10 +97,20 @@ func (c *Client) EnsureRegistration(ctx context.Context, acceptedTermsURI string
 	}
 
 	if accountURL == "" {
-		account, err := c.acmeClient.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+		var eab *acme.ExternalAccountBinding
+		if c.eab != nil {
+			eab, err = c.eab.acme()
+			if err != nil {
+				return nil, err
+			}
+		} else if dir.ExternalAccountRequired {
+			return nil, ErrExternalAccountRequired
+		}
+		account, err := c.acmeClient.Register(ctx, &acme.Account{ExternalAccountBinding: eab}, acme.AcceptTOS)
 		if err != nil {
 			return nil, fmt.Errorf("register: %w", err)
 		}
+		c.setAccountURL(account.URI)
 		return account, nil
 	} else {
 		account, err := c.acmeClient.GetReg(ctx, accountURL)
@@ -79,68 +120,228 @@ func (c *Client) EnsureRegistration(ctx context.Context, acceptedTermsURI string
 		if account.Status != acme.StatusValid {
 			return nil, fmt.Errorf("account %q statis is %q", account.URI, account.Status)
 		}
+		c.setAccountURL(account.URI)
 		return account, nil
 	}
 }
 
-func (c *Client) GetDomain() (string, error) {
-	acctReq, err := acmeutil.CaptureAccountRequest(c.acmeClient)
+// directoryURL returns the ACME directory URL, which defaults to Let's
+// Encrypt.
+func (c *Client) directoryURL() string {
+	if c.acmeClient.DirectoryURL == "" {
+		return acme.LetsEncryptURL
+	}
+	return c.acmeClient.DirectoryURL
+}
+
+func (c *Client) setAccountURL(accountURL string) {
+	c.accountMu.Lock()
+	defer c.accountMu.Unlock()
+	c.accountURL = accountURL
+}
+
+// getAccountURL returns the account URL from EnsureRegistration or else
+// looks it up by key.
+func (c *Client) getAccountURL(ctx context.Context) (string, error) {
+	c.accountMu.Lock()
+	accountURL := c.accountURL
+	c.accountMu.Unlock()
+	if accountURL != "" {
+		return accountURL, nil
+	}
+	account, err := c.acmeClient.GetReg(ctx, "")
+	if err != nil {
+		return "", fmt.Errorf("account: %w", err)
+	}
+	c.setAccountURL(account.URI)
+	return account.URI, nil
+}
+
+// signer returns a signer for localcert server requests, which the server
+// forwards to the ACME server.
+func (c *Client) signer(dir acme.Directory, kid string) *acmeutil.Signer {
+	return &acmeutil.Signer{
+		Key:        c.acmeClient.Key,
+		KID:        kid,
+		NonceURL:   dir.NonceURL,
+		HTTPClient: c.acmeClient.HTTPClient,
+		UserAgent:  c.acmeClient.UserAgent,
+	}
+}
+
+func (c *Client) GetDomain(ctx context.Context) (string, error) {
+	dir, err := c.acmeClient.Discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("discover: %w", err)
+	}
+	acctReq, err := c.signer(dir, "").SignAccountLookup(ctx, dir.RegURL)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("account request: %w", err)
 	}
 
 	var domainRes DomainResult
-	err = c.localcertPost("/domain", DomainRequest{AccountRequest: acctReq}, &domainRes)
+	err = c.localcertPost(ctx, "/domain", DomainRequest{
+		ACMEDirectoryURL: c.directoryURL(),
+		AccountRequest:   acctReq,
+	}, &domainRes)
 	if err != nil {
 		return "", fmt.Errorf("domain: %w", err)
 	}
 	return domainRes.Domain, nil
 }
 
-func (c *Client) ProvisionDomain(ctx context.Context, domain string) (*acme.Order, error) {
-	id := acme.AuthzID{Type: "dns", Value: domain}
-	order, err := c.acmeClient.AuthorizeOrder(ctx, []acme.AuthzID{id})
+// ProvisionDomain orders a certificate for domain and any additional names,
+// which must be domain's base domain (without "*.") or subdomains of it,
+// e.g. "*.api.<id>.user.localcert.dev". Each authorization is provisioned
+// by the localcert server.
+func (c *Client) ProvisionDomain(ctx context.Context, domain string, names ...string) (*acme.Order, error) {
+	return c.RenewDomain(ctx, nil, domain, names...)
+}
+
+// RenewDomain is like ProvisionDomain, but if the ACME server supports
+// renewal information (ARI), the order is marked as replacing the existing
+// certificate, which may be nil. If the server rejects the replacement, e.g.
+// because the certificate was already replaced, a plain order is used.
+func (c *Client) RenewDomain(ctx context.Context, existing *x509.Certificate, domain string, names ...string) (*acme.Order, error) {
+	ids, err := orderIdentifiers(domain, names)
 	if err != nil {
-		return nil, fmt.Errorf("new order: %w", err)
+		return nil, err
+	}
+	var order *acme.Order
+	if certID, ok := c.replacesCertID(ctx, existing); ok {
+		order, err = c.newOrderReplacing(ctx, ids, certID)
+		var acmeErr *acme.Error
+		if errors.As(err, &acmeErr) && acmeErr.StatusCode < 500 {
+			log.Printf("Order replacing %s rejected; ordering without replacement: %v", certID, err)
+			order = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("new order: %w", err)
+		}
+	}
+	if order == nil {
+		order, err = c.acmeClient.AuthorizeOrder(ctx, ids)
+		if err != nil {
+			return nil, fmt.Errorf("new order: %w", err)
+		}
 	}
 	// TODO: validate Order (?)
 
-	authzURI := order.AuthzURLs[0]
-	authzReq, err := acmeutil.CaptureAuthorizationRequest(c.acmeClient, authzURI)
+	for _, authzURI := range order.AuthzURLs {
+		if err := c.provisionAuthorization(ctx, authzURI); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = c.acmeClient.WaitOrder(ctx, order.URI)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("order wait: %w", err)
+	}
+
+	return order, nil
+}
+
+func (c *Client) provisionAuthorization(ctx context.Context, authzURI string) error {
+	authz, err := c.acmeClient.GetAuthorization(ctx, authzURI)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		// Reused from a previous order
+		return nil
+	}
+
+	dir, err := c.acmeClient.Discover(ctx)
+	if err != nil {
+		return fmt.Errorf("discover: %w", err)
+	}
+	accountURL, err := c.getAccountURL(ctx)
+	if err != nil {
+		return err
+	}
+	authzReq, err := c.signer(dir, accountURL).SignPostAsGet(ctx, authzURI)
+	if err != nil {
+		return fmt.Errorf("authorization request: %w", err)
 	}
 
 	var provisionRes ProvisionResult
-	err = c.localcertPost("/provision", ProvisionRequest{
+	err = c.localcertPost(ctx, "/provision", ProvisionRequest{
+		ACMEDirectoryURL:     c.directoryURL(),
 		PublicKey:            &jose.JSONWebKey{Key: c.acmeClient.Key.Public()},
 		AuthorizationRequest: authzReq,
 	}, &provisionRes)
 	if err != nil {
-		return nil, fmt.Errorf("provision: %w", err)
+		return fmt.Errorf("provision %q: %w", authz.Identifier.Value, err)
 	}
 
 	_, err = c.acmeClient.Accept(ctx, &acme.Challenge{URI: provisionRes.ProvisionedChallengeURL})
 	if err != nil {
-		return nil, fmt.Errorf("challenge accept: %w", err)
+		return fmt.Errorf("challenge accept: %w", err)
 	}
 
-	order, err = c.acmeClient.WaitOrder(ctx, order.URI)
+	_, err = c.acmeClient.WaitAuthorization(ctx, authzURI)
 	if err != nil {
 		if chal, err := c.acmeClient.GetChallenge(ctx, provisionRes.ProvisionedChallengeURL); err == nil {
 			log.Printf("Challenge error: %#v", chal.Error)
 		}
-		return nil, fmt.Errorf("order wait: %w", err)
+		return fmt.Errorf("authorization wait %q: %w", authz.Identifier.Value, err)
 	}
+	return nil
+}
 
-	return order, nil
+// replacesCertID returns the ARI cert ID of existing, if the ACME server
+// supports ARI.
+func (c *Client) replacesCertID(ctx context.Context, existing *x509.Certificate) (string, bool) {
+	if existing == nil {
+		return "", false
+	}
+	certID, err := CertID(existing)
+	if err != nil {
+		return "", false
+	}
+	if _, err := c.renewalInfoURL(ctx); err != nil {
+		return "", false
+	}
+	return certID, true
+}
+
+// orderIdentifiers returns the order identifiers for domain and names,
+// checking that each name is under domain.
+func orderIdentifiers(domain string, names []string) ([]acme.AuthzID, error) {
+	base := strings.TrimPrefix(domain, "*.")
+	ids := []acme.AuthzID{{Type: "dns", Value: domain}}
+	seen := map[string]bool{domain: true}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if seen[name] {
+			continue
+		}
+		if name != base && !strings.HasSuffix(name, "."+base) {
+			return nil, fmt.Errorf("name %q is not under domain %q", name, base)
+		}
+		seen[name] = true
+		ids = append(ids, acme.AuthzID{Type: "dns", Value: name})
+	}
+	return ids, nil
 }
 
+// GetCertificate finalizes order with a CSR for all of its identifiers.
+// The subject common name is the shortest wildcard identifier, which is the
+// localcert domain for orders from ProvisionDomain.
 func (c *Client) GetCertificate(ctx context.Context, order *acme.Order, certKey crypto.Signer) ([][]byte, error) {
-	name := order.Identifiers[0].Value
+	var names []string
+	for _, id := range order.Identifiers {
+		names = append(names, id.Value)
+	}
+	commonName := names[0]
+	for _, name := range names {
+		isWildcard := strings.HasPrefix(name, "*.")
+		if isWildcard && (!strings.HasPrefix(commonName, "*.") || len(name) < len(commonName)) {
+			commonName = name
+		}
+	}
 	req := &x509.CertificateRequest{
-		Subject:  pkix.Name{CommonName: name},
-		DNSNames: []string{name},
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: names,
 	}
 	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, req, certKey)
 	if err != nil {
@@ -151,13 +352,75 @@ func (c *Client) GetCertificate(ctx context.Context, order *acme.Order, certKey
 	return bundle, err
 }
 
-func (c *Client) localcertPost(urlSuffix string, req interface{}, res interface{}) error {
+// RevokeCertificate revokes a DER-encoded certificate for reason. The
+// request is signed with certKey, the certificate's private key, if it is
+// non-nil, and otherwise with the account key, which must be the account
+// the certificate was issued to. Revoking an already revoked certificate
+// isn't an error.
+func (c *Client) RevokeCertificate(ctx context.Context, cert []byte, certKey crypto.Signer, reason acme.CRLReasonCode) error {
+	// acme.Client currently ignores alreadyRevoked problems too, but
+	// RevokeCertificate's doc promises it.
+	err := c.acmeClient.RevokeCert(ctx, certKey, cert, reason)
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) && acmeErr.ProblemType == problemAlreadyRevoked {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("revoke certificate: %w", err)
+	}
+	return nil
+}
+
+// problemAlreadyRevoked is the ACME problem type for revoking a revoked
+// certificate (RFC 8555 section 6.7).
+const problemAlreadyRevoked = "urn:ietf:params:acme:error:alreadyRevoked"
+
+func (c *Client) acmeDo(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", c.acmeClient.UserAgent)
+	return c.acmeClient.HTTPClient.Do(req)
+}
+
+// acmePost posts a signed request to the ACME server, returning problem
+// responses as *acme.Error.
+func (c *Client) acmePost(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", acmeutil.RequestContentType)
+	resp, err := c.acmeDo(req)
+	if err != nil {
+		return nil, err
+	}
+	if statusErr := acmeutil.ErrorFromResponse(resp); statusErr != nil {
+		resp.Body.Close()
+		return nil, acmeError(statusErr)
+	}
+	return resp, nil
+}
+
+// acmeError converts a problem response from the ACME server to an
+// *acme.Error, as returned by acme.Client.
+func acmeError(statusErr *acmeutil.StatusError) *acme.Error {
+	return &acme.Error{
+		StatusCode:  statusErr.Code,
+		ProblemType: statusErr.Body.Type,
+		Detail:      statusErr.Body.Detail,
+		Instance:    statusErr.Body.Instance,
+	}
+}
+
+func (c *Client) localcertPost(ctx context.Context, urlSuffix string, req interface{}, res interface{}) error {
 	url := c.serverURL + urlSuffix
 	body, err := json.Marshal(req)
 	if err != nil {
 		return fmt.Errorf("json encode: %w", err)
 	}
-	resp, err := c.acmeClient.HTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.acmeClient.HTTPClient.Do(httpReq)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,173 @@
+package localcert_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/acmetest"
+)
+
+// TestProvisionConcurrent provisions certificates for many accounts at once,
+// each with several concurrent orders on one Client, all sharing
+// http.DefaultClient. Run with -race.
+func TestProvisionConcurrent(t *testing.T) {
+	const accounts = 8
+	const ordersPerAccount = 3
+
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	domains := make([]string, accounts)
+	for i := range domains {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			domain, err := provisionAccount(ctx, srv, ordersPerAccount)
+			if err != nil {
+				t.Errorf("account %d: %v", i, err)
+			}
+			domains[i] = domain
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		if seen[domain] {
+			t.Errorf("domain %q assigned to more than one account", domain)
+		}
+		seen[domain] = true
+	}
+	if issued := len(srv.CA.Issued()); issued != accounts*ordersPerAccount {
+		t.Errorf("CA issued %d certificates, want %d", issued, accounts*ordersPerAccount)
+	}
+}
+
+// provisionAccount registers a new account and provisions orders
+// certificates for it concurrently with one Client, returning its domain.
+func provisionAccount(ctx context.Context, srv *acmetest.Server, orders int) (string, error) {
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	client := srv.ClientConfig(accountKey).Client()
+	account, err := client.EnsureRegistration(ctx, "", "")
+	if err != nil {
+		return "", err
+	}
+	domain, err := client.GetDomain(ctx)
+	if err != nil {
+		return "", err
+	}
+	if want := srv.Domain(account.URI); domain != want {
+		return "", fmt.Errorf("domain = %q, want %q", domain, want)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, orders)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("n%d.%s", i, strings.TrimPrefix(domain, "*."))
+			errs[i] = provisionName(ctx, client, domain, name)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+	return domain, nil
+}
+
+func provisionName(ctx context.Context, client *localcert.Client, domain, name string) error {
+	order, err := client.ProvisionDomain(ctx, domain, name)
+	if err != nil {
+		return err
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := client.GetCertificate(ctx, order, certKey)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+	if err := cert.VerifyHostname(name); err != nil {
+		return err
+	}
+	if cert.Subject.CommonName != domain {
+		return fmt.Errorf("certificate common name = %q, want %q", cert.Subject.CommonName, domain)
+	}
+	return nil
+}
+
+// TestRevokeCertificateTwice checks that revoking a revoked certificate
+// succeeds, so an interrupted revoke -reprovision can be rerun.
+func TestRevokeCertificateTwice(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.ClientConfig(accountKey).Client()
+	if _, err := client.EnsureRegistration(ctx, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	domain, err := client.GetDomain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := client.ProvisionDomain(ctx, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := client.GetCertificate(ctx, order, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := client.RevokeCertificate(ctx, cert.Raw, certKey, acme.CRLReasonKeyCompromise); err != nil {
+			t.Fatalf("revocation %d: %v", i+1, err)
+		}
+	}
+	if reason, revoked := srv.CA.Revoked(cert); !revoked || reason != acme.CRLReasonKeyCompromise {
+		t.Errorf("Revoked = %v, %v; want %v, true", reason, revoked, acme.CRLReasonKeyCompromise)
+	}
+}
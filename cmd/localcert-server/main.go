@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/lann/localcert/internal/dnsserver"
+	"github.com/lann/localcert/internal/server"
+)
+
+var (
+	flagListen            = flag.String("listen", ":8080", "HTTP API listen address")
+	flagZone              = flag.String("zone", "user.localcert.dev", "parent zone of user domains")
+	flagACMEDirectoryURL  = flag.String("acmeUrl", "", "default ACME directory URL (default Let's Encrypt)")
+	flagACMEDirectoryURLs = flag.String("acmeUrls", "", "comma-separated directory URLs of other ACME CAs that clients may use")
+	flagRecordTTL         = flag.Duration("recordTTL", time.Hour, "how long challenge records are published")
+	flagDNSAddr           = flag.String("dnsAddr", ":53", "authoritative DNS listen address (empty to disable)")
+	flagNameservers       = flag.String("nameservers", "", "comma-separated NS names for the zone")
+	flagHostmaster        = flag.String("hostmaster", "", "SOA hostmaster mailbox (default hostmaster.<zone>)")
+)
+
+func main() {
+	flag.Parse()
+	if *flagZone == "" {
+		log.Fatal("-zone is required")
+	}
+
+	var acmeDirectoryURLs []string
+	if *flagACMEDirectoryURLs != "" {
+		acmeDirectoryURLs = strings.Split(*flagACMEDirectoryURLs, ",")
+	}
+
+	records := server.NewMemoryRecords(*flagRecordTTL)
+	srv := server.New(server.Config{
+		Zone:              *flagZone,
+		ACMEDirectoryURL:  *flagACMEDirectoryURL,
+		ACMEDirectoryURLs: acmeDirectoryURLs,
+		Records:           records,
+	})
+
+	if *flagDNSAddr != "" {
+		var nameservers []string
+		if *flagNameservers != "" {
+			nameservers = strings.Split(*flagNameservers, ",")
+		}
+		handler := dnsserver.New(dnsserver.Config{
+			Zone:        *flagZone,
+			Nameservers: nameservers,
+			Hostmaster:  *flagHostmaster,
+			TXT:         records,
+		})
+		for _, network := range []string{"udp", "tcp"} {
+			dnsServer := &dns.Server{Addr: *flagDNSAddr, Net: network, Handler: handler}
+			go func() {
+				log.Fatalf("DNS server (%s) error: %v", dnsServer.Net, dnsServer.ListenAndServe())
+			}()
+		}
+		log.Printf("Serving DNS for %q on %s", *flagZone, *flagDNSAddr)
+	}
+
+	log.Printf("Serving localcert API for %q on %s", *flagZone, *flagListen)
+	log.Fatal(http.ListenAndServe(*flagListen, srv))
+}
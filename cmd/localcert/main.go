@@ -1,21 +1,51 @@
 package main
 
 import (
-	"flag"
 	"log"
+	"os"
 
 	"github.com/lann/localcert/internal/cli"
 )
 
 func main() {
-	flag.Parse()
-	subcmd := flag.Arg(0)
-	switch flag.Arg(0) {
+	subcmd, args := cli.ParseArgs(os.Args[1:])
+	var code int
+	switch subcmd {
 	case "provision", "":
-		cli.Provision()
+		code = noArgs(args, cli.Provision)
+	case "renew":
+		code = noArgs(args, cli.Renew)
 	case "test":
-		cli.Test()
+		code = noArgs(args, cli.Test)
+	case "proxy":
+		code = noArgs(args, cli.Proxy)
+	case "doctor":
+		code = noArgs(args, cli.Doctor)
+	case "hostname":
+		code = cli.Hostname(args)
+	case "export":
+		code = cli.Export(args)
+	case "account":
+		code = cli.Account(args)
+	case "revoke":
+		code = noArgs(args, cli.Revoke)
 	default:
-		log.Fatalf("Invalid subcommand %q", subcmd)
+		log.Printf("Invalid subcommand %q", subcmd)
+		code = exitUsage
 	}
+	os.Exit(code)
+}
+
+// exitUsage is the exit code for invalid arguments, as from the flag
+// package.
+const exitUsage = 2
+
+// noArgs runs a subcommand that takes only flags, failing if there are
+// any other arguments.
+func noArgs(args []string, run func() int) int {
+	if len(args) > 0 {
+		log.Printf("Unexpected arguments %q", args)
+		return exitUsage
+	}
+	return run()
 }
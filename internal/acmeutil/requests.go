@@ -7,8 +7,11 @@ import (
 )
 
 type SignedRequest struct {
-	Content  []byte
-	KID, URL string
+	Content         []byte
+	KID, URL, Nonce string
+
+	// JWK is the embedded public key of requests signed without a KID.
+	JWK *jose.JSONWebKey
 
 	jws *jose.JSONWebSignature
 }
@@ -29,7 +32,14 @@ func ParseSignedRequest(body []byte) (*SignedRequest, error) {
 		return nil, fmt.Errorf("invalid url %q", url)
 	}
 
-	return &SignedRequest{Content: body, KID: sig.Header.KeyID, URL: url, jws: jws}, nil
+	return &SignedRequest{
+		Content: body,
+		KID:     sig.Header.KeyID,
+		URL:     url,
+		Nonce:   sig.Protected.Nonce,
+		JWK:     sig.Header.JSONWebKey,
+		jws:     jws,
+	}, nil
 }
 
 func (r *SignedRequest) UnsafePayload() []byte {
@@ -0,0 +1,185 @@
+package acmeutil
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const RequestContentType = "application/jose+json"
+
+// Signer signs ACME requests with an account key. See RFC 8555 section 6.2.
+type Signer struct {
+	// Key is the account key, an *ecdsa.PrivateKey (P-256 or P-384) or an
+	// *rsa.PrivateKey.
+	Key crypto.Signer
+
+	// KID is the account URL. If empty, requests embed the public key as a
+	// "jwk" header instead, as for newAccount requests.
+	KID string
+
+	// NonceURL is the ACME server's newNonce URL.
+	NonceURL string
+
+	HTTPClient *http.Client
+	UserAgent  string
+}
+
+// SignAccountLookup returns a newAccount request for regURL with
+// onlyReturnExisting set, which returns the existing account for the key.
+// The JWK is always embedded, regardless of KID.
+func (s *Signer) SignAccountLookup(ctx context.Context, regURL string) ([]byte, error) {
+	return s.sign(ctx, regURL, []byte(`{"onlyReturnExisting":true}`), true)
+}
+
+// SignPostAsGet returns a POST-as-GET request for url. See RFC 8555
+// section 6.3.
+func (s *Signer) SignPostAsGet(ctx context.Context, url string) ([]byte, error) {
+	if s.KID == "" {
+		return nil, fmt.Errorf("POST-as-GET request requires a KID")
+	}
+	return s.sign(ctx, url, nil, false)
+}
+
+// Sign returns a request for url with the given JSON payload.
+func (s *Signer) Sign(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	return s.sign(ctx, url, payload, s.KID == "")
+}
+
+// SignKeyChange returns a keyChange request for url that replaces the
+// account key with newKey. See RFC 8555 section 7.3.5.
+func (s *Signer) SignKeyChange(ctx context.Context, url string, newKey crypto.Signer) ([]byte, error) {
+	if s.KID == "" {
+		return nil, fmt.Errorf("keyChange request requires a KID")
+	}
+	oldKey, err := json.Marshal(jose.JSONWebKey{Key: s.Key.Public()})
+	if err != nil {
+		return nil, fmt.Errorf("encode old key: %w", err)
+	}
+	payload, err := json.Marshal(struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}{s.KID, oldKey})
+	if err != nil {
+		return nil, err
+	}
+	// The inner JWS is signed by the new key, without a nonce.
+	inner, err := (&Signer{Key: newKey}).signJWS(url, payload, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("inner: %w", err)
+	}
+	return s.sign(ctx, url, inner, false)
+}
+
+func (s *Signer) sign(ctx context.Context, url string, payload []byte, embedJWK bool) ([]byte, error) {
+	return s.signJWS(url, payload, embedJWK, nonceSource{ctx, s})
+}
+
+func (s *Signer) signJWS(url string, payload []byte, embedJWK bool, nonces jose.NonceSource) ([]byte, error) {
+	alg, err := SigningAlgorithm(s.Key)
+	if err != nil {
+		return nil, err
+	}
+	key := jose.JSONWebKey{Key: s.Key}
+	if !embedJWK {
+		key.KeyID = s.KID
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, &jose.SignerOptions{
+		NonceSource:  nonces,
+		EmbedJWK:     embedJWK,
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"url": url},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signer: %w", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return flattenedJSON(jws)
+}
+
+// flattenedJSON serializes jws in the flattened JSON form required by ACME.
+// Unlike jose.JSONWebSignature.FullSerialize, it keeps the empty payload of
+// POST-as-GET requests.
+func flattenedJSON(jws *jose.JSONWebSignature) ([]byte, error) {
+	compact, err := jws.CompactSerialize()
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("serialize: expected 3 parts, got %d", len(parts))
+	}
+	return json.Marshal(struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{parts[0], parts[1], parts[2]})
+}
+
+// Nonce fetches a fresh nonce from the ACME server.
+func (s *Signer) Nonce(ctx context.Context) (string, error) {
+	if s.NonceURL == "" {
+		return "", fmt.Errorf("missing newNonce URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.NonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if s.UserAgent != "" {
+		req.Header.Set("User-Agent", s.UserAgent)
+	}
+	httpClient := s.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("new nonce: %w", err)
+	}
+	defer resp.Body.Close()
+	if statusErr := ErrorFromResponse(resp); statusErr != nil {
+		return "", fmt.Errorf("new nonce: %w", statusErr)
+	}
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("new nonce: missing Replay-Nonce header")
+	}
+	return nonce, nil
+}
+
+// nonceSource adapts Signer.Nonce to jose.NonceSource.
+type nonceSource struct {
+	ctx    context.Context
+	signer *Signer
+}
+
+func (ns nonceSource) Nonce() (string, error) {
+	return ns.signer.Nonce(ns.ctx)
+}
+
+// SigningAlgorithm returns the JWS algorithm for an account key.
+func SigningAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	}
+	return "", fmt.Errorf("unsupported account key type %T", key)
+}
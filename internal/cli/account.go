@@ -0,0 +1,305 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"golang.org/x/crypto/acme"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/lann/localcert"
+)
+
+const (
+	// The new account is staged under accountSuffixNext during a key
+	// rollover, so an interrupted rollover can be finished.
+	accountSuffixNext = ".next"
+
+	// A deactivated account is kept under accountSuffixDeactivated.
+	accountSuffixDeactivated = ".deactivated"
+)
+
+var flagYes = flag.Bool("yes", false, "don't ask for confirmation, e.g. for account deactivate")
+
+// accountInfo describes the ACME account in commandResult.
+type accountInfo struct {
+	Status        string `json:"status,omitempty"`
+	KeyType       string `json:"keyType"`
+	DirectoryURL  string `json:"directoryUrl"`
+	AcceptedTerms string `json:"acceptedTerms,omitempty"`
+	Domain        string `json:"domain,omitempty"`
+}
+
+// Account shows or manages the ACME account: account show, rollover or
+// deactivate.
+func Account(args []string) int {
+	res := newResult("account")
+	if len(args) == 0 {
+		log.Print("Usage: localcert account show|rollover|deactivate")
+		return exitUsage
+	}
+	action := args[0]
+	if len(args) > 1 {
+		log.Printf("Unexpected arguments %q", args[1:])
+		return exitUsage
+	}
+	run, ok := map[string]func(context.Context, *Config, *commandResult) error{
+		"show":       accountShow,
+		"rollover":   accountRollover,
+		"deactivate": accountDeactivate,
+	}[action]
+	if !ok {
+		log.Printf("Invalid account action %q; expected show, rollover or deactivate", action)
+		return exitUsage
+	}
+	res.Command = "account " + action
+
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+
+	config, err := newConfig()
+	if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	// account rollover applies AccountKeyType itself, keeping the account.
+	config.keepAccountKey = true
+	unlock, err := config.lockAndLoad(ctx)
+	if errors.Is(err, errLocked) {
+		return res.fail(classLocked, "Error", err)
+	} else if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	defer unlock()
+	res.setConfig(config)
+	if config.ACME.PrivateKey.KeyID == "" {
+		return res.fail(classConfig, "Error", fmt.Errorf("no ACME account in %q; run `localcert provision` first", config.location(localcert.CacheKeyACMEAccount)))
+	}
+
+	if err := run(ctx, config, res); err != nil {
+		return res.fail("", "Account error", err)
+	}
+	res.setConfig(config)
+	return res.exit(exitOK)
+}
+
+func accountShow(ctx context.Context, config *Config, res *commandResult) error {
+	client := config.Client()
+	account, err := client.GetAccount(ctx)
+	if err != nil {
+		return err
+	}
+	if account.URI != config.ACME.PrivateKey.KeyID {
+		printLine("Warning: the ACME server returned account URL %q", account.URI)
+	}
+	info := newAccountInfo(config)
+	info.Status = account.Status
+	// A deactivated account has no domain.
+	if account.Status == acme.StatusValid {
+		domain, err := client.GetDomain(ctx)
+		if err != nil {
+			return fmt.Errorf("get localcert domain name: %w", err)
+		}
+		info.Domain = domain
+	}
+	res.Account = info
+
+	if !jsonOutput() {
+		fmt.Println("Account URL:   ", config.ACME.PrivateKey.KeyID)
+		fmt.Println("Status:        ", info.Status)
+		fmt.Println("Key type:      ", info.KeyType)
+		fmt.Println("Directory:     ", info.DirectoryURL)
+		if info.AcceptedTerms != "" {
+			fmt.Println("Accepted terms:", info.AcceptedTerms)
+		}
+		if info.Domain != "" {
+			fmt.Println("Domain:        ", info.Domain)
+		}
+	}
+	return nil
+}
+
+// accountRollover replaces the account key with a new key of type
+// config.AccountKeyType, or of the same type. The account URL and so the
+// localcert domain stay the same.
+func accountRollover(ctx context.Context, config *Config, res *commandResult) error {
+	keyType := config.AccountKeyType
+	oldKeyType := localcert.KeyTypeOf(config.acmeKey)
+	if keyType == "" {
+		keyType = oldKeyType
+	}
+
+	client := config.Client()
+	domain, err := client.GetDomain(ctx)
+	if err != nil {
+		return fmt.Errorf("get localcert domain name: %w", err)
+	}
+
+	newKey, err := keyType.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	next := *config.ACME
+	next.PrivateKey = &jose.JSONWebKey{Key: newKey, KeyID: config.ACME.PrivateKey.KeyID}
+	nextBytes, err := next.Marshal()
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	nextKey := localcert.CacheKeyACMEAccount + accountSuffixNext
+	if err := config.Storage.Put(ctx, nextKey, nextBytes); err != nil {
+		return fmt.Errorf("write %q: %w", config.location(nextKey), err)
+	}
+
+	printLine("Rolling over %s account key to a new %s key...", keyTypeName(oldKeyType), keyType)
+	if err := client.RolloverAccountKey(ctx, newKey); err != nil {
+		if err := config.Storage.Delete(ctx, nextKey); err != nil {
+			log.Printf("Error deleting %q: %v", config.location(nextKey), err)
+		}
+		return err
+	}
+	if err := commitAccountRollover(ctx, config, &next); err != nil {
+		return err
+	}
+
+	// The localcert server derives the domain from the account URL, which
+	// doesn't change; check that it accepts the new key.
+	newDomain, err := config.Client().GetDomain(ctx)
+	if err != nil {
+		return fmt.Errorf("get localcert domain name with new key: %w", err)
+	}
+	if newDomain != domain {
+		printLine("The localcert server has assigned you a new domain!")
+		printLine("  Old domain: %q", domain)
+		printLine("  New domain: %q", newDomain)
+	}
+	printLine("Account key rolled over; domain %q", newDomain)
+
+	res.Account = newAccountInfo(config)
+	res.Account.Status = acme.StatusValid
+	res.Account.Domain = newDomain
+	return nil
+}
+
+// finishAccountRollover finishes a key rollover that was interrupted after
+// staging the new account, keeping whichever key the ACME server accepts.
+func finishAccountRollover(ctx context.Context, config *Config, logf func(string, ...interface{})) error {
+	nextKey := localcert.CacheKeyACMEAccount + accountSuffixNext
+	nextBytes, err := config.Storage.Get(ctx, nextKey)
+	if errors.Is(err, localcert.ErrCacheMiss) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read %q: %w", config.location(nextKey), err)
+	}
+	next, err := localcert.ParseACMEAccount(nextBytes)
+	if err != nil {
+		return fmt.Errorf("decode %q: %w", config.location(nextKey), err)
+	}
+
+	nextClient := localcert.Config{
+		ACMEPrivateKey:     next.Signer(),
+		ACMEDirectoryURL:   next.DirectoryURL,
+		LocalCertServerURL: config.ServerURL,
+	}.Client()
+	account, err := nextClient.GetAccount(ctx)
+	if errors.Is(err, acme.ErrNoAccount) {
+		logf("Discarding the new key from an interrupted account key rollover")
+		return config.Storage.Delete(ctx, nextKey)
+	} else if err != nil {
+		return err
+	}
+	if account.URI != config.ACME.PrivateKey.KeyID {
+		return fmt.Errorf("new key in %q belongs to account %q, not %q", config.location(nextKey), account.URI, config.ACME.PrivateKey.KeyID)
+	}
+	logf("Finishing an interrupted account key rollover")
+	return commitAccountRollover(ctx, config, next)
+}
+
+// commitAccountRollover stores the staged account after the ACME server has
+// accepted its key.
+func commitAccountRollover(ctx context.Context, config *Config, next *localcert.ACMEAccount) error {
+	nextKey := localcert.CacheKeyACMEAccount + accountSuffixNext
+	config.ACME = next
+	config.acmeKey = next.Signer()
+	if err := config.WriteACMEAccount(ctx); err != nil {
+		return fmt.Errorf("write acmeAccount %q (the new key is in %q): %w", config.location(localcert.CacheKeyACMEAccount), config.location(nextKey), err)
+	}
+	if err := config.Storage.Delete(ctx, nextKey); err != nil {
+		return fmt.Errorf("delete %q: %w", config.location(nextKey), err)
+	}
+	return nil
+}
+
+// accountDeactivate permanently deactivates the account and moves it aside,
+// so the next renewal registers a new account with a new domain.
+func accountDeactivate(ctx context.Context, config *Config, res *commandResult) error {
+	accountURL := config.ACME.PrivateKey.KeyID
+	err := confirm(fmt.Sprintf("Deactivate ACME account %s? This can't be undone; certificates issued to it stay valid until they expire.", accountURL),
+		"deactivating the account requires confirmation; pass -yes")
+	if err != nil {
+		return err
+	}
+	if err := config.Client().DeactivateAccount(ctx); err != nil {
+		return err
+	}
+	printLine("Deactivated ACME account %s", accountURL)
+
+	deactivatedKey := localcert.CacheKeyACMEAccount + accountSuffixDeactivated
+	accountBytes, err := config.ACME.Marshal()
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := config.Storage.Put(ctx, deactivatedKey, accountBytes); err != nil {
+		return fmt.Errorf("write %q: %w", config.location(deactivatedKey), err)
+	}
+	if err := config.Storage.Delete(ctx, localcert.CacheKeyACMEAccount); err != nil {
+		return fmt.Errorf("delete %q: %w", config.location(localcert.CacheKeyACMEAccount), err)
+	}
+	printLine("Moved the account to %q; the next renewal registers a new account, which is assigned a new domain", config.location(deactivatedKey))
+
+	res.Account = newAccountInfo(config)
+	res.Account.Status = acme.StatusDeactivated
+	return nil
+}
+
+func newAccountInfo(config *Config) *accountInfo {
+	return &accountInfo{
+		KeyType:       keyTypeName(localcert.KeyTypeOf(config.acmeKey)),
+		DirectoryURL:  config.ACME.DirectoryURL,
+		AcceptedTerms: config.ACME.AcceptedTerms,
+	}
+}
+
+// confirm asks a yes/no question, returning an error with refusal if the
+// answer is no. With -yes it doesn't ask; without a terminal or with
+// -output json it returns the error.
+func confirm(question, refusal string) error {
+	if *flagYes {
+		return nil
+	}
+	if jsonOutput() || !isatty.IsTerminal(os.Stdin.Fd()) {
+		return configError{errors.New(refusal)}
+	}
+	fmt.Println(question)
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("(Y)es/(N)o: ")
+		ans, err := stdin.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("prompt: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(ans)) {
+		case "y", "yes":
+			return nil
+		case "n", "no":
+			return configError{errors.New(refusal)}
+		}
+	}
+}
@@ -1,17 +1,20 @@
 package cli
 
 import (
+	"bytes"
+	"context"
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/lann/localcert"
 	"golang.org/x/crypto/acme"
@@ -19,10 +22,12 @@ import (
 )
 
 const (
-	defaultServerURL        = "https://api.localcert.dev"
+	defaultServerURL        = localcert.DefaultServerURL
 	defaultACMEDirectoryURL = acme.LetsEncryptURL
 
 	filePerm = 0700
+
+	eabHMACKeyEnv = "LOCALCERT_EAB_HMAC_KEY"
 )
 
 var (
@@ -32,8 +37,39 @@ var (
 	flagACMEAccountFile  = flag.String("acmeAccount", "", "path to ACME account file")
 	flagCertificateFile  = flag.String("localCert", "", "path to localcert certificate")
 	flagKeyFile          = flag.String("localKey", "", "path to localcert certificate key")
+	flagStorageHelper    = flag.String("storageHelper", "", "command used to store the account and certificate instead of files (see localcert.ExecCache)")
+	flagEABKeyID         = flag.String("eabKeyId", "", "external account binding key ID, for ACME CAs that require one")
+	flagEABHMACKey       = flag.String("eabHmacKey", "", "external account binding HMAC key (default $"+eabHMACKeyEnv+")")
 )
 
+// ParseArgs parses the flags in args, e.g. os.Args[1:], returning the
+// subcommand and its positional arguments. Flags may come before or after
+// the subcommand and its arguments, e.g. `localcert export pem=x.pem
+// -exportPassword foo`; arguments after "--" are never flags. Flags must be
+// parsed only once, as repeatable flags like -name accumulate.
+func ParseArgs(args []string) (subcmd string, subArgs []string) {
+	var positional []string
+	for {
+		flag.CommandLine.Parse(args)
+		rest := flag.Args()
+		if len(rest) == 0 {
+			break
+		}
+		// Parse stops at the first positional argument, or after "--".
+		if parsed := args[:len(args)-len(rest)]; len(parsed) > 0 && parsed[len(parsed)-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	if len(positional) == 0 {
+		return "", nil
+	}
+	return positional[0], positional[1:]
+}
+
+// Config is the CLI configuration, from the flags, and the ACME account.
 type Config struct {
 	DataDir         string
 	ServerURL       string
@@ -41,153 +77,423 @@ type Config struct {
 	CertificateFile string
 	KeyFile         string
 
-	ACME    *ACMEAccount
+	// StorageHelper is the -storageHelper command, if any.
+	StorageHelper string
+
+	// Storage holds the ACME account, certificate and key. By default it
+	// stores them in the files above; with -storageHelper the file paths
+	// are empty.
+	Storage localcert.Cache
+
+	// ACMEDirectoryURL is the ACME directory for new accounts, and must
+	// match existing accounts if set. If empty, new accounts use Let's
+	// Encrypt.
+	ACMEDirectoryURL string
+
+	// ExternalAccountBinding is stored with new ACME accounts, and replaces
+	// the binding of existing accounts, if set.
+	ExternalAccountBinding *localcert.ExternalAccountBinding
+
+	// AcceptTerms accepts the ACME server's terms of service without
+	// asking.
+	AcceptTerms bool
+
+	// Names are additional certificate names, relative to the localcert
+	// domain or absolute. See expandNames.
+	Names []string
+
+	// KeyType and AccountKeyType are the requested certificate and ACME
+	// account key types, if any. Existing keys of other types are replaced
+	// if ReplaceKeys is set or the user agrees.
+	KeyType        localcert.KeyType
+	AccountKeyType localcert.KeyType
+	ReplaceKeys    bool
+
+	// RotateKey generates a new certificate key for each renewal.
+	RotateKey bool
+
+	// ForceRenew renews the certificate even if it isn't due.
+	ForceRenew bool
+
+	// Exports are written after each renewal, PKCS#12 formats with
+	// ExportPassword.
+	Exports        []export
+	ExportPassword string
+
+	// Hooks are run after each renewal.
+	Hooks deployHooks
+
+	// Daemon keeps renew running, checking the certificate every
+	// RenewInterval.
+	Daemon        bool
+	RenewInterval time.Duration
+
+	// Timeout limits each provisioning attempt, if positive.
+	Timeout time.Duration
+
+	// LockWait is how long Lock waits for another process.
+	LockWait time.Duration
+
+	ACME    *localcert.ACMEAccount
 	acmeKey crypto.Signer
+
+	// keepAccountKey keeps an account key that doesn't match
+	// AccountKeyType instead of replacing it, for `account rollover`.
+	keepAccountKey bool
+
+	// locked is set by Lock.
+	locked bool
+}
+
+func GetConfig(ctx context.Context) (*Config, error) {
+	config, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.load(ctx); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
-func GetConfig() (*Config, error) {
-	flag.Parse()
-	dataDir := *flagDataDir
-	if dataDir == "" {
+// GetLockedConfig is like GetConfig but first takes the data directory
+// lock, for subcommands that write to it. Callers must call unlock when
+// done.
+func GetLockedConfig(ctx context.Context) (config *Config, unlock func(), err error) {
+	config, err = newConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err = config.lockAndLoad(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, unlock, nil
+}
+
+// lockAndLoad takes the data directory lock and loads the stored state.
+func (c *Config) lockAndLoad(ctx context.Context) (unlock func(), err error) {
+	unlock, err = c.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(ctx); err != nil {
+		unlock()
+		return nil, configError{err}
+	}
+	return unlock, nil
+}
+
+// newConfig returns a Config for the flags parsed by ParseArgs, without
+// reading any stored state.
+func newConfig() (*Config, error) {
+	if err := checkOutputFlag(); err != nil {
+		return nil, err
+	}
+	keyType, err := parseKeyTypeFlag("keyType", *flagKeyType)
+	if err != nil {
+		return nil, err
+	}
+	accountKeyType, err := parseKeyTypeFlag("accountKeyType", *flagAccountKeyType)
+	if err != nil {
+		return nil, err
+	}
+	eab, err := externalAccountBindingFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{
+		DataDir:                *flagDataDir,
+		ServerURL:              *flagServerURL,
+		ACMEAccountFile:        *flagACMEAccountFile,
+		CertificateFile:        *flagCertificateFile,
+		KeyFile:                *flagKeyFile,
+		StorageHelper:          *flagStorageHelper,
+		ACMEDirectoryURL:       *flagACMEDirectoryURL,
+		ExternalAccountBinding: eab,
+		AcceptTerms:            *flagAcceptTerms,
+		Names:                  append([]string(nil), flagNames...),
+		KeyType:                keyType,
+		AccountKeyType:         accountKeyType,
+		ReplaceKeys:            *flagReplaceKeys,
+		RotateKey:              *flagRotateKey,
+		ForceRenew:             *flagForceRenew,
+		Exports:                append([]export(nil), flagExports...),
+		ExportPassword:         exportPassword(),
+		Hooks: deployHooks{
+			Command: *flagDeployHook,
+			PidFile: *flagReloadPidFile,
+			Signal:  *flagReloadSignal,
+			URL:     *flagReloadURL,
+		},
+		Daemon:        *flagDaemon,
+		RenewInterval: *flagRenewInterval,
+		Timeout:       *flagTimeout,
+		LockWait:      *flagLockWait,
+	}
+	if err := c.initStorage(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// initStorage sets Storage and the default file paths under DataDir, or
+// the default data directory if DataDir is empty.
+func (c *Config) initStorage() error {
+	if c.StorageHelper != "" {
+		helper := strings.Fields(c.StorageHelper)
+		c.DataDir, c.ACMEAccountFile, c.CertificateFile, c.KeyFile = "", "", "", ""
+		c.Storage = &localcert.ExecCache{Command: helper[0], Args: helper[1:]}
+		return nil
+	}
+
+	if c.DataDir == "" {
 		userConfigDir, err := os.UserConfigDir()
 		if err != nil {
-			return nil, fmt.Errorf("user config dir: %w", err)
+			return fmt.Errorf("user config dir: %w", err)
 		}
-		dataDir = filepath.Join(userConfigDir, "localcert")
+		c.DataDir = filepath.Join(userConfigDir, "localcert")
 
 		// In the common case of the default dataDir not yet existing, try creating it
-		if _, err := os.Stat(dataDir); errors.Is(err, os.ErrNotExist) {
-			err := os.Mkdir(dataDir, filePerm)
+		if _, err := os.Stat(c.DataDir); errors.Is(err, os.ErrNotExist) {
+			err := os.Mkdir(c.DataDir, filePerm)
 			if err != nil {
-				return nil, fmt.Errorf("create default config dir: %w", err)
+				return fmt.Errorf("create default config dir: %w", err)
 			}
 		}
 	}
 
-	acmeAccountFile := *flagACMEAccountFile
-	if acmeAccountFile == "" {
-		acmeAccountFile = filepath.Join(dataDir, "acme_account.json")
+	if c.ACMEAccountFile == "" {
+		c.ACMEAccountFile = filepath.Join(c.DataDir, localcert.CacheKeyACMEAccount)
 	}
-
-	certificateFile := *flagCertificateFile
-	if certificateFile == "" {
-		certificateFile = filepath.Join(dataDir, "cert.pem")
+	if c.CertificateFile == "" {
+		c.CertificateFile = filepath.Join(c.DataDir, localcert.CacheKeyCertificate)
 	}
-
-	keyFile := *flagKeyFile
-	if keyFile == "" {
-		keyFile = filepath.Join(dataDir, "privkey.pem")
+	if c.KeyFile == "" {
+		c.KeyFile = filepath.Join(c.DataDir, localcert.CacheKeyCertificateKey)
+	}
+	c.Storage = fileStorage{
+		localcert.CacheKeyACMEAccount:    c.ACMEAccountFile,
+		localcert.CacheKeyCertificate:    c.CertificateFile,
+		localcert.CacheKeyCertificateKey: c.KeyFile,
 	}
+	return nil
+}
 
-	config := &Config{
-		DataDir:         dataDir,
-		ServerURL:       *flagServerURL,
-		ACMEAccountFile: acmeAccountFile,
-		CertificateFile: certificateFile,
-		KeyFile:         keyFile,
+// load reads the ACME account and, if locked, finishes any interrupted
+// account key rollover and certificate and key write. Without the lock
+// another process may be in the middle of them, so load only reads.
+func (c *Config) load(ctx context.Context) error {
+	if err := c.readOrGenerateACMEAccount(ctx); err != nil {
+		return err
 	}
-	if err := config.readOrGenerateACMEAccount(); err != nil {
-		return nil, err
+	if c.locked {
+		// Using the old key after the ACME server has accepted the new one
+		// would register a new account.
+		if err := finishAccountRollover(ctx, c, printLine); err != nil {
+			return fmt.Errorf("finish account key rollover: %w", err)
+		}
+		if err := localcert.RecoverCertificate(ctx, c.Storage); err != nil {
+			return fmt.Errorf("recover certificate key: %w", err)
+		}
+	}
+	c.setCertificateKeyType()
+	return nil
+}
+
+// setCertificateKeyType applies KeyType, which is persisted in the ACME
+// account file for later renewals.
+func (c *Config) setCertificateKeyType() {
+	if c.KeyType != "" {
+		c.ACME.CertificateKeyType = c.KeyType
 	}
-	return config, nil
 }
 
-func (c *Config) ReadOrGenerateCertificateKey() (crypto.Signer, error) {
-	keyBytes, err := os.ReadFile(c.KeyFile)
+// ReadOrGenerateCertificateKey returns the key for a new certificate and
+// whether it is newly generated. New keys aren't stored until they are
+// written with their certificate by WriteCertificateAndKey.
+func (c *Config) ReadOrGenerateCertificateKey(ctx context.Context) (crypto.Signer, bool, error) {
+	if c.RotateKey {
+		return c.generateCertificateKey()
+	}
+	keyPEM, err := c.Storage.Get(ctx, localcert.CacheKeyCertificateKey)
 	if err == nil {
-		key, err := x509.ParseECPrivateKey(keyBytes)
-		if err != nil {
-			return nil, fmt.Errorf("decode: %w", err)
-		}
-		return key, nil
-	} else if errors.Is(err, os.ErrNotExist) {
-		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		key, legacy, err := localcert.DecodePrivateKeyPEM(keyPEM)
 		if err != nil {
-			return nil, fmt.Errorf("generate: %w", err)
+			return nil, false, fmt.Errorf("decode %q: %w", c.location(localcert.CacheKeyCertificateKey), err)
 		}
-
-		keyBytes, err := x509.MarshalECPrivateKey(key)
-		if err != nil {
-			return nil, fmt.Errorf("encode: %w", err)
+		if want := c.ACME.CertificateKeyType; want != "" && localcert.KeyTypeOf(key) != want {
+			if err := c.confirmReplaceKey("certificate key", localcert.KeyTypeOf(key), want, ""); err != nil {
+				return nil, false, err
+			}
+			return c.generateCertificateKey()
 		}
-
-		err = WritePEMFile(c.KeyFile, privateKeyPEMType, keyBytes)
-		if err != nil {
-			return nil, fmt.Errorf("write %q: %w", c.KeyFile, err)
+		if legacy {
+			// Rewrite keys from earlier versions so other tools can read them.
+			keyPEM, err := localcert.EncodePrivateKeyPEM(key)
+			if err != nil {
+				return nil, false, fmt.Errorf("encode: %w", err)
+			}
+			err = c.Storage.Put(ctx, localcert.CacheKeyCertificateKey, keyPEM)
+			if err != nil {
+				return nil, false, fmt.Errorf("write %q: %w", c.location(localcert.CacheKeyCertificateKey), err)
+			}
+			log.Printf("Rewrote certificate key %q as PKCS#8", c.location(localcert.CacheKeyCertificateKey))
 		}
-
-		return key, nil
+		return key, false, nil
+	} else if errors.Is(err, localcert.ErrCacheMiss) {
+		return c.generateCertificateKey()
 	} else {
-		return nil, fmt.Errorf("read %q: %w", c.KeyFile, err)
+		return nil, false, fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyCertificateKey), err)
 	}
 }
 
-func (c *Config) ReadCertificate() (*x509.Certificate, error) {
-	certBytes, err := ReadPEMFile(c.CertificateFile, certificatePEMType)
+func (c *Config) generateCertificateKey() (crypto.Signer, bool, error) {
+	key, err := c.ACME.CertificateKeyType.GenerateKey()
+	if err != nil {
+		return nil, false, fmt.Errorf("generate: %w", err)
+	}
+	return key, true, nil
+}
+
+func (c *Config) ReadCertificate(ctx context.Context) (*x509.Certificate, error) {
+	data, err := c.Storage.Get(ctx, localcert.CacheKeyCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyCertificate), err)
+	}
+	certBytes, err := decodePEM(data, certificatePEMType)
 	if err != nil {
-		return nil, fmt.Errorf("read %q: %w", c.CertificateFile, err)
+		return nil, fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyCertificate), err)
 	}
 	return x509.ParseCertificate(certBytes)
 }
 
+func (c *Config) ReadTLSCertificate(ctx context.Context) (tls.Certificate, error) {
+	certPEM, err := c.Storage.Get(ctx, localcert.CacheKeyCertificate)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyCertificate), err)
+	}
+	keyPEM, err := c.Storage.Get(ctx, localcert.CacheKeyCertificateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyCertificateKey), err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (c *Config) WriteCertificate(ctx context.Context, certChain [][]byte) error {
+	var buf bytes.Buffer
+	for _, certBytes := range certChain {
+		err := pem.Encode(&buf, &pem.Block{Type: certificatePEMType, Bytes: certBytes})
+		if err != nil {
+			return err
+		}
+	}
+	return c.Storage.Put(ctx, localcert.CacheKeyCertificate, buf.Bytes())
+}
+
+// WriteCertificateAndKey stores a certificate chain with its new key,
+// keeping the previous pair as .prev files. See localcert.PutCertificate.
+func (c *Config) WriteCertificateAndKey(ctx context.Context, certChain [][]byte, key crypto.Signer) error {
+	return localcert.PutCertificate(ctx, c.Storage, certChain, key)
+}
+
+// location describes where key is stored, for messages.
+func (c *Config) location(key string) string {
+	if fs, ok := c.Storage.(fileStorage); ok {
+		if path, err := fs.path(key); err == nil {
+			return path
+		}
+	}
+	return key
+}
+
 func (c *Config) Client() *localcert.Client {
 	return localcert.Config{
-		ACMEPrivateKey:     c.ACME.PrivateKey.Key.(crypto.Signer),
-		ACMEDirectoryURL:   c.ACME.DirectoryURL,
-		LocalCertServerURL: c.ServerURL,
+		ACMEPrivateKey:         c.ACME.PrivateKey.Key.(crypto.Signer),
+		ACMEDirectoryURL:       c.ACME.DirectoryURL,
+		ExternalAccountBinding: c.ACME.ExternalAccountBinding,
+		LocalCertServerURL:     c.ServerURL,
 	}.Client()
 }
 
-func (c *Config) WriteACMEAccountFile() error {
-	fileBytes, err := json.MarshalIndent(c.ACME, "", "  ")
+func (c *Config) WriteACMEAccount(ctx context.Context) error {
+	fileBytes, err := c.ACME.Marshal()
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
-	return os.WriteFile(c.ACMEAccountFile, fileBytes, filePerm)
-}
-
-type ACMEAccount struct {
-	DirectoryURL  string           `json:"directoryURL"`
-	PrivateKey    *jose.JSONWebKey `json:"privateKey"`
-	AcceptedTerms string           `json:"acceptedTerms"`
+	return c.Storage.Put(ctx, localcert.CacheKeyACMEAccount, fileBytes)
 }
 
-func (c *Config) readOrGenerateACMEAccount() error {
-	dirURL := *flagACMEDirectoryURL
-	fileBytes, err := os.ReadFile(c.ACMEAccountFile)
+func (c *Config) readOrGenerateACMEAccount(ctx context.Context) error {
+	dirURL := c.ACMEDirectoryURL
+	accountKeyType := c.AccountKeyType
+	eab := c.ExternalAccountBinding
+	fileBytes, err := c.Storage.Get(ctx, localcert.CacheKeyACMEAccount)
 	if err == nil {
-		c.ACME = &ACMEAccount{}
-		err := json.Unmarshal(fileBytes, c.ACME)
+		c.ACME, err = localcert.ParseACMEAccount(fileBytes)
 		if err != nil {
 			return fmt.Errorf("decode acmeAccount: %w", err)
 		}
 
-		if dirURL != "" && dirURL != c.ACME.DirectoryURL {
-			return fmt.Errorf("acmeAccount directory URL %q != acmeUrl %q", c.ACME.DirectoryURL, dirURL)
+		// Accounts from earlier versions may have an empty directory URL.
+		accountDirURL := c.ACME.DirectoryURL
+		if accountDirURL == "" {
+			accountDirURL = defaultACMEDirectoryURL
+		}
+		if dirURL != "" && dirURL != accountDirURL {
+			return fmt.Errorf("acmeAccount directory URL %q != acmeUrl %q", accountDirURL, dirURL)
+		}
+		if eab != nil {
+			c.ACME.ExternalAccountBinding = eab
 		}
 
-		jwk := c.ACME.PrivateKey
-		acmeKey, ok := jwk.Key.(crypto.Signer)
-		if !ok {
-			return fmt.Errorf("decode acmeAccount: invalid privateKey type %T", jwk.Key)
+		if have := localcert.KeyTypeOf(c.ACME.Signer()); accountKeyType != "" && have != accountKeyType && !c.keepAccountKey {
+			if err := c.confirmReplaceKey("ACME account key", have, accountKeyType,
+				"Replacing it registers a new ACME account, which is assigned a new localcert domain. To keep the domain, run `localcert account rollover` instead."); err != nil {
+				return err
+			}
+			key, err := accountKeyType.GenerateKey()
+			if err != nil {
+				return fmt.Errorf("generate key: %w", err)
+			}
+			c.ACME.PrivateKey = &jose.JSONWebKey{Key: key}
 		}
-		c.acmeKey = acmeKey
+
+		c.acmeKey = c.ACME.Signer()
 		return nil
-	} else if errors.Is(err, os.ErrNotExist) {
-		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else if errors.Is(err, localcert.ErrCacheMiss) {
+		key, err := accountKeyType.GenerateKey()
 		if err != nil {
 			return fmt.Errorf("generate key: %w", err)
 		}
 		if dirURL == "" {
 			dirURL = defaultACMEDirectoryURL
 		}
-		c.ACME = &ACMEAccount{
-			DirectoryURL: *flagACMEDirectoryURL,
-			PrivateKey:   &jose.JSONWebKey{Key: key},
+		c.ACME = &localcert.ACMEAccount{
+			DirectoryURL:           dirURL,
+			PrivateKey:             &jose.JSONWebKey{Key: key},
+			ExternalAccountBinding: eab,
 		}
 		c.acmeKey = key
 		return nil
 	} else {
-		return fmt.Errorf("read %q: %w", c.ACMEAccountFile, err)
+		return fmt.Errorf("read %q: %w", c.location(localcert.CacheKeyACMEAccount), err)
+	}
+}
+
+// externalAccountBindingFlags returns the binding from -eabKeyId and
+// -eabHmacKey, if set. It is stored in the ACME account file.
+func externalAccountBindingFlags() (*localcert.ExternalAccountBinding, error) {
+	hmacKey := *flagEABHMACKey
+	if hmacKey == "" {
+		hmacKey = os.Getenv(eabHMACKeyEnv)
+	}
+	if *flagEABKeyID == "" && *flagEABHMACKey == "" {
+		return nil, nil
+	}
+	if *flagEABKeyID == "" || hmacKey == "" {
+		return nil, fmt.Errorf("-eabKeyId and -eabHmacKey (or $%s) must be set together", eabHMACKeyEnv)
 	}
+	return &localcert.ExternalAccountBinding{KeyID: *flagEABKeyID, HMACKey: hmacKey}, nil
 }
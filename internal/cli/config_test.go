@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseTestArgs sets os.Args to args and parses them like main, restoring
+// os.Args and the flags when the test ends.
+func parseTestArgs(t *testing.T, args ...string) (subcmd string, subArgs []string) {
+	t.Helper()
+	oldArgs := os.Args
+	t.Cleanup(func() {
+		os.Args = oldArgs
+		flag.Visit(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		flagNames = nil
+		flagExports = nil
+		flagExportPassword = passwordFlag{}
+	})
+	os.Args = append([]string{"localcert"}, args...)
+	return ParseArgs(os.Args[1:])
+}
+
+func TestParseArgsOnce(t *testing.T) {
+	subcmd, _ := parseTestArgs(t, "-name", "*.api", "-export", "pem=x.pem", "provision", "-name", "@", "-dataDir", t.TempDir())
+	if subcmd != "provision" {
+		t.Fatalf("subcmd = %q, want provision", subcmd)
+	}
+	config, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.api", "@"}; !reflect.DeepEqual(config.Names, want) {
+		t.Errorf("names = %q, want %q", config.Names, want)
+	}
+	if want := []export{{format: "pem", path: "x.pem"}}; !reflect.DeepEqual(config.Exports, want) {
+		t.Errorf("exports = %v, want %v", config.Exports, want)
+	}
+}
+
+func TestParseArgsInterleaved(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		subcmd   string
+		subArgs  []string
+		password string
+	}{
+		{nil, "", nil, ""},
+		{[]string{"-exportPassword", "foo"}, "", nil, "foo"},
+		{[]string{"export", "pem=x.pem", "-exportPassword", "foo", "der=x.der"}, "export", []string{"pem=x.pem", "der=x.der"}, "foo"},
+		{[]string{"account", "rollover", "-exportPassword", "foo"}, "account", []string{"rollover"}, "foo"},
+		{[]string{"renew", "extra"}, "renew", []string{"extra"}, ""},
+		{[]string{"hostname", "--", "-exportPassword", "foo"}, "hostname", []string{"-exportPassword", "foo"}, ""},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			subcmd, subArgs := parseTestArgs(t, tc.args...)
+			if subcmd != tc.subcmd || !reflect.DeepEqual(subArgs, tc.subArgs) {
+				t.Errorf("ParseArgs = %q, %q; want %q, %q", subcmd, subArgs, tc.subcmd, tc.subArgs)
+			}
+			if flagExportPassword.value != tc.password {
+				t.Errorf("-exportPassword = %q, want %q", flagExportPassword.value, tc.password)
+			}
+		})
+	}
+}
+
+func TestExportPassword(t *testing.T) {
+	t.Setenv(exportPasswordEnv, "from-env")
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "from-env"},
+		{[]string{"-exportPassword", "from-flag"}, "from-flag"},
+		{[]string{"-exportPassword", ""}, ""},
+	} {
+		parseTestArgs(t, append(tc.args, "-dataDir", t.TempDir(), "export")...)
+		config, err := newConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ExportPassword != tc.want {
+			t.Errorf("%q: export password = %q, want %q", tc.args, config.ExportPassword, tc.want)
+		}
+		if tc.want == "" {
+			if _, err := exportFormats["jks"](nil, nil, config.ExportPassword); err == nil {
+				t.Errorf("%q: jks export without a password succeeded", tc.args)
+			}
+		}
+		flagExportPassword = passwordFlag{}
+	}
+
+	t.Setenv(exportPasswordEnv, "")
+	parseTestArgs(t, "-dataDir", t.TempDir(), "export")
+	if password := exportPassword(); password != "" {
+		t.Errorf("empty $%s: export password = %q, want empty", exportPasswordEnv, password)
+	}
+}
+
+// TestLoadRecoversOnlyWhenLocked checks that unlocked commands leave a
+// staged certificate key alone, since another process may be writing it.
+func TestLoadRecoversOnlyWhenLocked(t *testing.T) {
+	config := &Config{DataDir: t.TempDir()}
+	if err := config.initStorage(); err != nil {
+		t.Fatal(err)
+	}
+	pendingFile := config.KeyFile + ".next"
+	if err := os.WriteFile(pendingFile, []byte("staged key"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+
+	if err := config.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pendingFile); err != nil {
+		t.Errorf("unlocked load: %v", err)
+	}
+
+	unlock, err := config.lockAndLoad(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := os.Stat(pendingFile); !os.IsNotExist(err) {
+		t.Errorf("locked load left the staged key: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var flagTimeout = flag.Duration("timeout", 5*time.Minute, "timeout for each provisioning attempt (0 for none)")
+
+// signalContext returns a context that is canceled on SIGINT or SIGTERM.
+// After the first signal the default behavior is restored, so a second
+// signal exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// withTimeout applies timeout, e.g. from the -timeout flag, to ctx if it is
+// positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
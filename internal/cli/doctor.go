@@ -0,0 +1,233 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const doctorTimeout = 5 * time.Second
+
+var flagDNSServer = flag.String("dnsServer", "", "authoritative DNS server address for doctor checks (default from NS lookup)")
+
+// doctorChecks are the names checked by Doctor and the addresses they
+// should resolve to.
+var doctorChecks = []struct {
+	label, ip string
+}{
+	{"localhost", "127.0.0.1"},
+	{"ip10-11-12-13", "10.11.12.13"},
+}
+
+type doctorReport struct {
+	checks []doctorCheck
+	failed bool
+}
+
+// doctorCheck is the result of a single check, as reported with -output
+// json.
+type doctorCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+var doctorStatusTags = map[string]string{"ok": " OK ", "warn": "WARN", "fail": "FAIL"}
+
+func (r *doctorReport) ok(format string, args ...interface{}) {
+	r.add("ok", "", format, args...)
+}
+
+func (r *doctorReport) warn(hint string, format string, args ...interface{}) {
+	r.add("warn", hint, format, args...)
+}
+
+func (r *doctorReport) fail(hint string, format string, args ...interface{}) {
+	r.failed = true
+	r.add("fail", hint, format, args...)
+}
+
+func (r *doctorReport) add(status, hint string, format string, args ...interface{}) {
+	check := doctorCheck{Status: status, Message: fmt.Sprintf(format, args...), Hint: hint}
+	r.checks = append(r.checks, check)
+	if jsonOutput() {
+		return
+	}
+	fmt.Printf("[%s] %s\n", doctorStatusTags[status], check.Message)
+	if hint != "" {
+		fmt.Printf("       %s\n", hint)
+	}
+}
+
+// Doctor runs diagnostics on the certificate and DNS resolution of
+// localcert names, exiting non-zero if any check fails.
+func Doctor() int {
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+
+	res := newResult("doctor")
+	config, err := GetConfig(ctx)
+	if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	res.setConfig(config)
+
+	report := &doctorReport{}
+	cert := checkCertificate(ctx, report, config)
+	if cert != nil {
+		res.setCertificate(cert)
+		domain := strings.TrimPrefix(cert.Subject.CommonName, "*.")
+		checkResolution(ctx, report, domain)
+	}
+	res.Checks = report.checks
+
+	if report.failed {
+		printLine("\nSome checks failed.")
+		return res.exit(exitFailure)
+	}
+	printLine("\nAll checks passed.")
+	return res.exit(exitOK)
+}
+
+func checkCertificate(ctx context.Context, report *doctorReport, config *Config) *x509.Certificate {
+	provisionHint := "Run `localcert` to provision a certificate."
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil {
+		report.fail(provisionHint, "Certificate: %v", err)
+		return nil
+	}
+	report.ok("Certificate for %q found", cert.Subject.CommonName)
+
+	if _, err := config.ReadTLSCertificate(ctx); err != nil {
+		report.fail("Run `localcert -forceRenew` to issue a certificate for the current key.", "Certificate key: %v", err)
+	} else {
+		report.ok("Certificate matches private key")
+	}
+
+	expiresIn := time.Until(cert.NotAfter)
+	if expiresIn <= 0 {
+		report.fail(provisionHint, "Certificate expired %s", cert.NotAfter.Format(time.RFC3339))
+	} else if expiresIn < renewBefore {
+		report.warn("Run `localcert` or `localcert renew -daemon` to renew it.", "Certificate expires soon (%s)", cert.NotAfter.Format(time.RFC3339))
+	} else {
+		report.ok("Certificate valid until %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return cert
+}
+
+func checkResolution(ctx context.Context, report *doctorReport, domain string) {
+	authServer := *flagDNSServer
+	if authServer == "" {
+		ns, err := lookupNameserver(ctx, domain)
+		if err != nil {
+			report.fail("Check your network connection and DNS settings.", "Finding authoritative nameserver for %q: %v", domain, err)
+		} else {
+			authServer = net.JoinHostPort(ns, "53")
+		}
+	}
+
+	for _, check := range doctorChecks {
+		name := check.label + "." + domain
+
+		var authIPs []string
+		if authServer != "" {
+			var err error
+			authIPs, err = lookupAuthoritative(ctx, name, authServer)
+			if err != nil {
+				report.fail("The localcert DNS server may be down; try again later.", "Authoritative lookup of %q via %s: %v", name, authServer, err)
+			} else if !resolvesTo(authIPs, check.ip) {
+				report.fail("The localcert DNS server returned an unexpected answer.", "Authoritative lookup of %q: got %v, want [%s]", name, authIPs, check.ip)
+			} else {
+				report.ok("Authoritative lookup of %q: %s", name, check.ip)
+			}
+		}
+
+		sysIPs, err := lookupSystem(ctx, name)
+		if err != nil || len(sysIPs) == 0 {
+			report.fail(rebindingHint, "System resolver lookup of %q: %v", name, errOrEmpty(err))
+		} else if !resolvesTo(sysIPs, check.ip) {
+			report.fail(rebindingHint, "System resolver lookup of %q: got %v, want [%s]", name, sysIPs, check.ip)
+		} else {
+			report.ok("System resolver lookup of %q: %s", name, check.ip)
+		}
+	}
+}
+
+const rebindingHint = "Your router or DNS resolver may be filtering private IP answers (DNS rebinding protection).\n" +
+	"       Allow the localcert domain in its settings, or use a public resolver like 1.1.1.1 or 8.8.8.8."
+
+// lookupNameserver finds an authoritative nameserver for domain or its
+// closest parent with NS records.
+func lookupNameserver(ctx context.Context, domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	var lastErr error
+	for name := domain; strings.Contains(name, "."); name = name[strings.Index(name, ".")+1:] {
+		nss, err := net.DefaultResolver.LookupNS(ctx, name)
+		if err == nil && len(nss) > 0 {
+			return strings.TrimSuffix(nss[0].Host, "."), nil
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("no NS records found: %v", lastErr)
+}
+
+// lookupAuthoritative looks up the A records for name by querying server
+// directly, bypassing the system resolver and its caches.
+func lookupAuthoritative(ctx context.Context, name, server string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	// The trailing dot keeps resolv.conf search domains from being
+	// appended.
+	addrs, err := resolver.LookupIP(ctx, "ip4", strings.TrimSuffix(name, ".")+".")
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	return ips, nil
+}
+
+func lookupSystem(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			ips = append(ips, ip4.String())
+		}
+	}
+	return ips, nil
+}
+
+// resolvesTo reports whether ips is exactly [want].
+func resolvesTo(ips []string, want string) bool {
+	return len(ips) == 1 && ips[0] == want
+}
+
+func errOrEmpty(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "no addresses"
+}
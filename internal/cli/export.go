@@ -0,0 +1,231 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/lann/localcert/internal/fileutil"
+)
+
+const exportPasswordEnv = "LOCALCERT_EXPORT_PASSWORD"
+
+var (
+	flagExports        exportsFlag
+	flagExportPassword passwordFlag
+)
+
+func init() {
+	flag.Var(&flagExportPassword, "exportPassword", "`password` for p12 and jks exports (default $"+exportPasswordEnv+" or \""+pkcs12.DefaultPassword+"\")")
+	flag.Var(&flagExports, "export", "also write the certificate as `format=path` after each renewal (repeatable); formats: "+strings.Join(exportFormatNames(), ", "))
+}
+
+// exportFormats encode a certificate chain and its private key.
+var exportFormats = map[string]func(chain []*x509.Certificate, key interface{}, password string) ([]byte, error){
+	// PKCS#12 with key, leaf and chain, e.g. for .NET and Windows.
+	"p12": encodePKCS12,
+	"pfx": encodePKCS12,
+	// PKCS#12 keystore for Java (keytool -storetype PKCS12), which requires
+	// a password.
+	"jks": func(chain []*x509.Certificate, key interface{}, password string) ([]byte, error) {
+		if password == "" {
+			return nil, errors.New("jks export requires a password")
+		}
+		return encodePKCS12(chain, key, password)
+	},
+	// Full chain followed by the key in one PEM file, e.g. for HAProxy.
+	"pem": func(chain []*x509.Certificate, key interface{}, _ string) ([]byte, error) {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return append(encodeCertsPEM(chain), encodePEM(privateKeyPEMType, keyBytes)...), nil
+	},
+	"leaf": func(chain []*x509.Certificate, _ interface{}, _ string) ([]byte, error) {
+		return encodeCertsPEM(chain[:1]), nil
+	},
+	"chain": func(chain []*x509.Certificate, _ interface{}, _ string) ([]byte, error) {
+		if len(chain) < 2 {
+			return nil, errors.New("the certificate has no intermediates")
+		}
+		return encodeCertsPEM(chain[1:]), nil
+	},
+	"der": func(chain []*x509.Certificate, _ interface{}, _ string) ([]byte, error) {
+		return chain[0].Raw, nil
+	},
+}
+
+func exportFormatNames() []string {
+	var names []string
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func encodePKCS12(chain []*x509.Certificate, key interface{}, password string) ([]byte, error) {
+	return pkcs12.Encode(rand.Reader, key, chain[0], chain[1:], password)
+}
+
+func encodeCertsPEM(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		buf.Write(encodePEM(certificatePEMType, cert.Raw))
+	}
+	return buf.Bytes()
+}
+
+// export is a certificate export destination.
+type export struct {
+	format, path string
+}
+
+type exportsFlag []export
+
+func (ef *exportsFlag) String() string {
+	var exports []string
+	for _, e := range *ef {
+		exports = append(exports, e.format+"="+e.path)
+	}
+	return strings.Join(exports, ",")
+}
+
+func (ef *exportsFlag) Set(value string) error {
+	e, err := parseExport(value)
+	if err != nil {
+		return err
+	}
+	*ef = append(*ef, e)
+	return nil
+}
+
+func parseExport(value string) (export, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return export{}, fmt.Errorf("invalid export %q; expected format=path", value)
+	}
+	format := strings.ToLower(strings.TrimSpace(parts[0]))
+	if _, ok := exportFormats[format]; !ok {
+		return export{}, fmt.Errorf("invalid export format %q; expected one of %s", format, strings.Join(exportFormatNames(), ", "))
+	}
+	return export{format: format, path: parts[1]}, nil
+}
+
+// passwordFlag is a string flag that records whether it was set, so that
+// an empty password can be told apart from the default.
+type passwordFlag struct {
+	value string
+	set   bool
+}
+
+func (pf *passwordFlag) String() string { return pf.value }
+
+func (pf *passwordFlag) Set(value string) error {
+	pf.value, pf.set = value, true
+	return nil
+}
+
+// exportPassword returns -exportPassword or $LOCALCERT_EXPORT_PASSWORD, even
+// if set to empty, for p12 exports without a password.
+func exportPassword() string {
+	if flagExportPassword.set {
+		return flagExportPassword.value
+	}
+	if password, ok := os.LookupEnv(exportPasswordEnv); ok {
+		return password
+	}
+	return pkcs12.DefaultPassword
+}
+
+// Export writes the stored certificate in the formats given as format=path
+// args and -export flags.
+func Export(args []string) int {
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+
+	res := newResult("export")
+	var argExports []export
+	for _, arg := range args {
+		e, err := parseExport(arg)
+		if err != nil {
+			return res.fail(classConfig, "Error", err)
+		}
+		argExports = append(argExports, e)
+	}
+	if len(argExports) == 0 && len(flagExports) == 0 {
+		log.Printf("Usage: localcert export <format>=<path>...; formats: %s", strings.Join(exportFormatNames(), ", "))
+		return exitUsage
+	}
+
+	config, unlock, err := GetLockedConfig(ctx)
+	if errors.Is(err, errLocked) {
+		return res.fail(classLocked, "Error", err)
+	} else if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	defer unlock()
+	res.setConfig(config)
+	exports := append(config.Exports, argExports...)
+
+	cert, err := writeExports(ctx, config, exports, printLine)
+	if err != nil {
+		return res.fail(classConfig, "Export error", err)
+	}
+	res.setCertificate(cert)
+	for _, e := range exports {
+		res.Exports = append(res.Exports, e.path)
+	}
+	return res.exit(exitOK)
+}
+
+// runExports writes config.Exports, reporting each with logf.
+func runExports(ctx context.Context, config *Config, logf func(string, ...interface{})) error {
+	if len(config.Exports) == 0 {
+		return nil
+	}
+	_, err := writeExports(ctx, config, config.Exports, logf)
+	return err
+}
+
+// writeExports writes the stored certificate and key in each export's
+// format, returning the certificate.
+func writeExports(ctx context.Context, config *Config, exports []export, logf func(string, ...interface{})) (*x509.Certificate, error) {
+	tlsCert, err := config.ReadTLSCertificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for _, certBytes := range tlsCert.Certificate {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	for _, e := range exports {
+		data, err := exportFormats[e.format](chain, tlsCert.PrivateKey, config.ExportPassword)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", e.format, err)
+		}
+		// Most formats include the private key.
+		if err := fileutil.WriteAtomic(e.path, data, 0600); err != nil {
+			return nil, fmt.Errorf("export %s: %w", e.format, err)
+		}
+		logf("Exported %s: %s", e.format, e.path)
+	}
+	return chain[0], nil
+}
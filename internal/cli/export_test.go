@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestExportFormats(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.test.localcert.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []*x509.Certificate{leaf, leaf}
+
+	for _, format := range exportFormatNames() {
+		data, err := exportFormats[format](chain, key, "secret")
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+		} else if len(data) == 0 {
+			t.Errorf("%s: empty export", format)
+		}
+	}
+
+	pemData, err := exportFormats["pem"](chain, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+		types = append(types, block.Type)
+	}
+	if len(types) != 3 || types[2] != privateKeyPEMType {
+		t.Errorf("pem export blocks = %q, want chain then key", types)
+	}
+
+	if _, err := exportFormats["chain"](chain[:1], key, ""); err == nil {
+		t.Error("chain export without intermediates succeeded")
+	}
+}
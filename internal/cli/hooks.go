@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const hookTimeout = time.Minute
+
+var (
+	flagDeployHook    = flag.String("deployHook", "", "shell command to run after a new certificate is issued")
+	flagReloadPidFile = flag.String("reloadPidFile", "", "pidfile of a process to signal after a new certificate is issued")
+	flagReloadSignal  = flag.String("reloadSignal", "HUP", "signal sent to the -reloadPidFile process")
+	flagReloadURL     = flag.String("reloadUrl", "", "local HTTP endpoint to POST to after a new certificate is issued")
+)
+
+// deployHooks are run after a new certificate is issued.
+type deployHooks struct {
+	// Command is a shell command, run with deployInfo environment
+	// variables.
+	Command string
+
+	// PidFile is the pidfile of a process to send Signal.
+	PidFile string
+	Signal  string
+
+	// URL is a local HTTP endpoint to POST deployInfo to.
+	URL string
+}
+
+// deployInfo is passed to deploy hooks, as environment variables for
+// commands and as a JSON body for HTTP endpoints.
+type deployInfo struct {
+	CertificateFile string `json:"certificateFile"`
+	KeyFile         string `json:"keyFile"`
+	Domain          string `json:"domain"`
+	NotAfter        string `json:"notAfter"`
+}
+
+func (info deployInfo) environ() []string {
+	return append(os.Environ(),
+		"LOCALCERT_CERT_FILE="+info.CertificateFile,
+		"LOCALCERT_KEY_FILE="+info.KeyFile,
+		"LOCALCERT_DOMAIN="+info.Domain,
+		"LOCALCERT_NOT_AFTER="+info.NotAfter,
+	)
+}
+
+// runDeployHooks runs each of config.Hooks, reporting the result of each
+// with logf. It returns an error if any hook failed.
+func runDeployHooks(config *Config, cert *x509.Certificate, logf func(string, ...interface{})) error {
+	info := deployInfo{
+		CertificateFile: config.CertificateFile,
+		KeyFile:         config.KeyFile,
+		Domain:          cert.Subject.CommonName,
+		NotAfter:        cert.NotAfter.Format(time.RFC3339),
+	}
+
+	var failed bool
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			logf("Deploy hook %s failed: %v", name, err)
+		} else {
+			logf("Deploy hook %s succeeded", name)
+		}
+	}
+	hooks := config.Hooks
+	if hooks.Command != "" {
+		report("command", runHookCommand(hooks.Command, info))
+	}
+	if hooks.PidFile != "" {
+		report("signal", signalHookPidFile(hooks.PidFile, hooks.Signal))
+	}
+	if hooks.URL != "" {
+		report("HTTP", postHookURL(hooks.URL, info))
+	}
+	if failed {
+		return errors.New("one or more deploy hooks failed")
+	}
+	return nil
+}
+
+func runHookCommand(command string, info deployInfo) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Env = info.environ()
+	// With -output json, stdout only holds the JSON result.
+	cmd.Stdout = textOutput()
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(hookTimeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	err := cmd.Wait()
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+		return fmt.Errorf("exit status %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+func signalHookPidFile(pidFile, signalName string) error {
+	sig, err := parseSignal(signalName)
+	if err != nil {
+		return err
+	}
+	pidBytes, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return fmt.Errorf("invalid pid in %q: %w", pidFile, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(sig); err != nil {
+		return fmt.Errorf("signal %s to pid %d: %w", signalName, pid, err)
+	}
+	return nil
+}
+
+func postHookURL(url string, info deployInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("json encode: %w", err)
+	}
+	client := &http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build plan9 || js || wasip1
+// +build plan9 js wasip1
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Plan 9 has notes rather than signals, and js and wasip1 can't signal
+// other processes; only the portable signals are supported.
+var hookSignals = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"KILL": os.Kill,
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := hookSignals[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %q; expected INT or KILL", name)
+}
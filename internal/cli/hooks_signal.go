@@ -0,0 +1,31 @@
+//go:build !plan9 && !js && !wasip1
+// +build !plan9,!js,!wasip1
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var hookSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := hookSignals[name]; ok {
+		return sig, nil
+	}
+	if num, err := strconv.Atoi(name); err == nil && num > 0 {
+		return syscall.Signal(num), nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", name)
+}
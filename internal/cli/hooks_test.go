@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/lann/localcert/acmetest"
+)
+
+func TestDeployHookOutputJSON(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	config := newTestConfig(t, srv)
+	config.Hooks.Command = "echo hook output"
+
+	output := *flagOutput
+	*flagOutput = "json"
+	defer func() { *flagOutput = output }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	read := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		read <- out
+	}()
+	code := provision(testContext(t), config)
+	os.Stdout = stdout
+	w.Close()
+	out := <-read
+
+	if code != exitOK {
+		t.Fatalf("provision exit code = %d, want %d", code, exitOK)
+	}
+	var res commandResult
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&res); err != nil {
+		t.Fatalf("stdout %q isn't a JSON result: %v", out, err)
+	}
+	if dec.More() {
+		t.Errorf("stdout %q has more than the JSON result", out)
+	}
+	if !res.Renewed {
+		t.Errorf("result %+v isn't renewed", res)
+	}
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/lann/localcert/internal/iplabel"
+)
+
+// Hostname prints the localcert hostname for each IP address in args.
+func Hostname(args []string) int {
+	res := newResult("hostname")
+	if len(args) == 0 {
+		log.Print("Usage: localcert hostname <ip>...")
+		return exitUsage
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+
+	config, err := GetConfig(ctx)
+	if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil {
+		return res.fail(classConfig, "Error reading certificate", err)
+	}
+	res.setCertificate(cert)
+	domain := strings.TrimPrefix(cert.Subject.CommonName, "*.")
+
+	for _, arg := range args {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return res.fail(classConfig, "Error", fmt.Errorf("invalid IP address %q", arg))
+		}
+		label, err := iplabel.Format(ip)
+		if err != nil {
+			return res.fail(classConfig, "Error", err)
+		}
+		hostname := label + "." + domain
+		res.Hostnames = append(res.Hostnames, hostname)
+		if !jsonOutput() {
+			fmt.Println(hostname)
+		}
+	}
+	return res.exit(exitOK)
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+
+	"github.com/lann/localcert"
+)
+
+var (
+	flagKeyType        = flag.String("keyType", "", "certificate key type: p256, p384, rsa2048, rsa3072 or rsa4096 (default: keep the existing key, or p256)")
+	flagAccountKeyType = flag.String("accountKeyType", "", "ACME account key type for new accounts: p256, p384, rsa2048, rsa3072 or rsa4096 (default p256)")
+	flagReplaceKeys    = flag.Bool("replaceKeys", false, "replace existing keys that don't match -keyType or -accountKeyType without asking")
+	flagRotateKey      = flag.Bool("rotateKey", false, "generate a new certificate key for each renewal, keeping the previous key and certificate as .prev files")
+)
+
+// parseKeyTypeFlag parses a key type flag, which may be empty.
+func parseKeyTypeFlag(name, value string) (localcert.KeyType, error) {
+	if value == "" {
+		return "", nil
+	}
+	kt, err := localcert.ParseKeyType(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid -%s: %w", name, err)
+	}
+	return kt, nil
+}
+
+// certHasRequestedKeyType reports whether cert's key is of the configured
+// certificate key type, if any.
+func certHasRequestedKeyType(config *Config, cert *x509.Certificate) bool {
+	want := config.ACME.CertificateKeyType
+	return want == "" || localcert.KeyTypeOf(cert.PublicKey) == want
+}
+
+// confirmReplaceKey asks whether to replace an existing key that doesn't
+// match the requested key type, unless ReplaceKeys is set, returning an
+// error if it shouldn't be. The note, if any, explains the consequences.
+func (c *Config) confirmReplaceKey(description string, have, want localcert.KeyType, note string) error {
+	mismatch := fmt.Sprintf("%s type is %s, not %s; pass -replaceKeys to replace it", description, keyTypeName(have), want)
+	if c.ReplaceKeys {
+		return nil
+	}
+	if jsonOutput() || !isatty.IsTerminal(os.Stdin.Fd()) {
+		if note != "" {
+			mismatch += ". " + strings.TrimSuffix(note, ".")
+		}
+		return errors.New(mismatch)
+	}
+
+	fmt.Printf("The %s type is %s, not %s.\n", description, keyTypeName(have), want)
+	if note != "" {
+		fmt.Println(note)
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Replace it with a new %s key? (Y)es/(N)o: ", want)
+		ans, err := stdin.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("prompt: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(ans)) {
+		case "y", "yes":
+			return nil
+		case "n", "no":
+			return errors.New(mismatch)
+		}
+	}
+}
+
+func keyTypeName(kt localcert.KeyType) string {
+	if kt == "" {
+		return "unsupported"
+	}
+	return string(kt)
+}
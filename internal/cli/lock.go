@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lann/localcert/internal/fileutil"
+)
+
+const (
+	lockFileName      = ".lock"
+	lockRetryInterval = 250 * time.Millisecond
+)
+
+var flagLockWait = flag.Duration("lockWait", 0, "how long to wait for another localcert process using the data directory (default: fail immediately)")
+
+// errLocked is returned by Config.Lock if another process holds the lock.
+var errLocked = errors.New("data directory is in use")
+
+// Lock takes an advisory lock on the data directory so that concurrent
+// localcert processes don't interleave writes to the account, certificate
+// and key. It waits up to LockWait for another process to finish. With
+// -storageHelper there is no data directory and unlock is a no-op.
+func (c *Config) Lock(ctx context.Context) (unlock func(), err error) {
+	if c.DataDir == "" {
+		c.locked = true
+		return func() {}, nil
+	}
+	lockFile := filepath.Join(c.DataDir, lockFileName)
+
+	ctx, cancel := context.WithTimeout(ctx, c.LockWait)
+	defer cancel()
+	for {
+		lock, err := fileutil.TryLock(lockFile)
+		if err == nil {
+			var once sync.Once
+			unlock = func() { once.Do(func() { lock.Unlock() }) }
+			c.locked = true
+			return unlock, nil
+		} else if !errors.Is(err, fileutil.ErrLocked) {
+			return nil, fmt.Errorf("lock %q: %w", lockFile, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %q is %v; wait for the other localcert process to finish or pass -lockWait", errLocked, lockFile, err)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/internal/acmeutil"
+)
+
+var flagOutput = flag.String("output", "text", "output format: text or json")
+
+// Exit codes.
+const (
+	exitOK      = 0
+	exitFailure = 1  // failures not covered below
+	exitUsage   = 2  // invalid flags or arguments, as from the flag package
+	exitNotDue  = 3  // certificate not due for renewal
+	exitConfig  = 4  // invalid configuration or unreadable local state
+	exitTerms   = 5  // ACME terms of service not accepted
+	exitACME    = 6  // the ACME server returned an error
+	exitServer  = 7  // the localcert server returned an error
+	exitNetwork = 8  // network error or timeout
+	exitHook    = 9  // a deploy hook failed after the certificate was renewed
+	exitLocked  = 10 // another localcert process is using the data directory
+)
+
+const exitCodesHelp = `
+Exit codes:
+  0   success (certificate renewed or provisioned)
+  1   other failure
+  2   invalid flags, arguments or subcommand
+  3   certificate not due for renewal
+  4   invalid configuration or unreadable local state
+  5   ACME terms of service not accepted
+  6   error from the ACME server
+  7   error from the localcert server
+  8   network error or timeout
+  9   deploy hook failed (the certificate was renewed)
+  10  another localcert process is using the data directory
+`
+
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprint(out, "Usage: localcert [flags] [provision|renew|test|proxy|doctor|hostname|export|account|revoke] [flags]\n\n")
+		flag.PrintDefaults()
+		fmt.Fprint(out, exitCodesHelp)
+	}
+}
+
+// Error classes reported in errorInfo.Class.
+const (
+	classError    = "error"
+	classCanceled = "canceled"
+	classConfig   = "config"
+	classTerms    = "terms"
+	classACME     = "acme"
+	classServer   = "server"
+	classNetwork  = "network"
+	classHook     = "hook"
+	classLocked   = "locked"
+)
+
+var classExitCodes = map[string]int{
+	classConfig:  exitConfig,
+	classTerms:   exitTerms,
+	classACME:    exitACME,
+	classServer:  exitServer,
+	classNetwork: exitNetwork,
+	classHook:    exitHook,
+	classLocked:  exitLocked,
+}
+
+func jsonOutput() bool {
+	return *flagOutput == "json"
+}
+
+func checkOutputFlag() error {
+	switch *flagOutput {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid -output %q; expected text or json", *flagOutput)
+}
+
+// textOutput is where human-readable progress is written; with -output
+// json it is stderr so stdout only holds the JSON result.
+func textOutput() io.Writer {
+	if jsonOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// commandResult is the result of a subcommand, written to stdout as a line
+// of JSON with -output json.
+type commandResult struct {
+	Command         string            `json:"command"`
+	Domain          string            `json:"domain,omitempty"`
+	Names           []string          `json:"names,omitempty"`
+	CertificateFile string            `json:"certificateFile,omitempty"`
+	KeyFile         string            `json:"keyFile,omitempty"`
+	StorageHelper   string            `json:"storageHelper,omitempty"`
+	NotBefore       *time.Time        `json:"notBefore,omitempty"`
+	NotAfter        *time.Time        `json:"notAfter,omitempty"`
+	Renewed         bool              `json:"renewed"`
+	AccountURL      string            `json:"accountUrl,omitempty"`
+	URL             string            `json:"url,omitempty"`
+	Routes          map[string]string `json:"routes,omitempty"`
+	Hostnames       []string          `json:"hostnames,omitempty"`
+	Exports         []string          `json:"exports,omitempty"`
+	Checks          []doctorCheck     `json:"checks,omitempty"`
+	Account         *accountInfo      `json:"account,omitempty"`
+	Revoked         *revocation       `json:"revoked,omitempty"`
+	Error           *errorInfo        `json:"error,omitempty"`
+}
+
+type errorInfo struct {
+	Class   string `json:"class"`
+	Message string `json:"message"`
+
+	// Status, Type and Detail are from ACME or localcert server problem
+	// responses.
+	Status int    `json:"status,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newResult(command string) *commandResult {
+	return &commandResult{Command: command}
+}
+
+func (r *commandResult) setConfig(config *Config) {
+	r.CertificateFile = config.CertificateFile
+	r.KeyFile = config.KeyFile
+	r.StorageHelper = config.StorageHelper
+	if config.ACME != nil {
+		r.AccountURL = config.ACME.PrivateKey.KeyID
+	}
+}
+
+func (r *commandResult) setCertificate(cert *x509.Certificate) {
+	r.Domain = cert.Subject.CommonName
+	r.Names = cert.DNSNames
+	r.NotBefore = &cert.NotBefore
+	r.NotAfter = &cert.NotAfter
+}
+
+// print writes r to stdout with -output json.
+func (r *commandResult) print() {
+	if !jsonOutput() {
+		return
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+		log.Print("Error writing output: ", err)
+	}
+}
+
+// exit prints r and returns code, the subcommand's exit code.
+func (r *commandResult) exit(code int) int {
+	r.print()
+	return code
+}
+
+// fail reports err and returns the exit code for its class. If class is
+// empty it is derived from err. In text mode msg prefixes the logged error.
+func (r *commandResult) fail(class, msg string, err error) int {
+	if class == "" {
+		class = errorClass(err)
+	}
+	code, ok := classExitCodes[class]
+	if !ok {
+		code = exitFailure
+	}
+	if !jsonOutput() {
+		log.Print(msg, ": ", err)
+		return code
+	}
+	r.Error = newErrorInfo(class, err)
+	return r.exit(code)
+}
+
+// errorClass classifies err by the part of provisioning that failed.
+func errorClass(err error) string {
+	var configErr configError
+	var termsErr localcert.TermsNotAcceptedError
+	var acmeErr *acme.Error
+	var statusErr *acmeutil.StatusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errLocked):
+		return classLocked
+	case errors.As(err, &configErr), errors.Is(err, localcert.ErrExternalAccountRequired):
+		return classConfig
+	case errors.As(err, &termsErr):
+		return classTerms
+	case errors.As(err, &acmeErr):
+		return classACME
+	case errors.As(err, &statusErr):
+		return classServer
+	case errors.Is(err, context.Canceled):
+		return classCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return classNetwork
+	}
+	return classError
+}
+
+// configError marks errors loading the configuration, for errorClass.
+type configError struct {
+	err error
+}
+
+func (ce configError) Error() string { return ce.err.Error() }
+func (ce configError) Unwrap() error { return ce.err }
+
+func newErrorInfo(class string, err error) *errorInfo {
+	info := &errorInfo{Class: class, Message: err.Error()}
+	var acmeErr *acme.Error
+	var statusErr *acmeutil.StatusError
+	if errors.As(err, &acmeErr) {
+		info.Status = acmeErr.StatusCode
+		info.Type = acmeErr.ProblemType
+		info.Detail = acmeErr.Detail
+	} else if errors.As(err, &statusErr) {
+		info.Status = statusErr.Code
+		info.Type = statusErr.Body.Type
+		info.Detail = statusErr.Body.Detail
+	}
+	return info
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"os"
 )
 
 const (
@@ -14,11 +13,7 @@ const (
 
 var errNotPEM = errors.New("no PEM data found")
 
-func ReadPEMFile(name, pemType string) ([]byte, error) {
-	data, err := os.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
+func decodePEM(data []byte, pemType string) ([]byte, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errNotPEM
@@ -29,7 +24,6 @@ func ReadPEMFile(name, pemType string) ([]byte, error) {
 	return block.Bytes, nil
 }
 
-func WritePEMFile(name, pemType string, content []byte) error {
-	block := &pem.Block{Type: pemType, Bytes: content}
-	return os.WriteFile(name, pem.EncodeToMemory(block), filePerm)
+func encodePEM(pemType string, content []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: content})
 }
@@ -1,121 +1,253 @@
 package cli
 
 import (
-	"bytes"
 	"context"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/lann/localcert"
 )
 
-var flagForceRenew = flag.Bool("forceRenew", false, "force renewel of certificate with > 30 days until expiration")
+const renewBefore = 30 * 24 * time.Hour
 
-func Provision() {
-	config, err := GetConfig()
+var (
+	flagForceRenew = flag.Bool("forceRenew", false, "force renewal of a certificate that isn't due for renewal")
+	flagNames      namesFlag
+)
+
+func init() {
+	flag.Var(&flagNames, "name", "additional certificate `name` under your domain, e.g. '*.api' or '@' for the bare domain (repeatable)")
+}
+
+// namesFlag collects additional certificate names, relative to the
+// localcert domain or absolute.
+type namesFlag []string
+
+func (nf *namesFlag) String() string {
+	return strings.Join(*nf, ",")
+}
+
+func (nf *namesFlag) Set(value string) error {
+	*nf = append(*nf, value)
+	return nil
+}
+
+// expandNames returns the absolute names for names under base, the
+// localcert domain without "*.".
+func expandNames(names []string, base string) []string {
+	var expanded []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == "@" {
+			name = base
+		} else if name != base && !strings.HasSuffix(name, "."+base) {
+			name += "." + base
+		}
+		expanded = append(expanded, name)
+	}
+	return expanded
+}
+
+// certHasRequestedNames reports whether cert's names are exactly its
+// domain plus config.Names.
+func certHasRequestedNames(config *Config, cert *x509.Certificate) bool {
+	domain := cert.Subject.CommonName
+	want := map[string]bool{domain: true}
+	for _, name := range expandNames(config.Names, strings.TrimPrefix(domain, "*.")) {
+		want[name] = true
+	}
+	if len(cert.DNSNames) != len(want) {
+		return false
+	}
+	for _, name := range cert.DNSNames {
+		if !want[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Provision provisions a certificate, or renews it if it is due, with the
+// flags, returning the exit code.
+func Provision() int {
+	ctx, stop := signalContext()
+	defer stop()
+
+	config, err := newConfig()
 	if err != nil {
-		log.Fatal("Config error: ", err)
+		return newResult("provision").fail(classConfig, "Config error", err)
+	}
+	return provision(ctx, config)
+}
+
+func provision(ctx context.Context, config *Config) int {
+	ctx, cancel := withTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	res := newResult("provision")
+	unlock, err := config.lockAndLoad(ctx)
+	if errors.Is(err, errLocked) {
+		return res.fail(classLocked, "Error", err)
+	} else if err != nil {
+		return res.fail(classConfig, "Config error", err)
 	}
+	defer unlock()
+	res.setConfig(config)
 
 	client := config.Client()
-	ctx := context.Background()
 
-	cert, err := config.ReadCertificate()
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("Error reading existing certificate %q: %v", config.CertificateFile, err)
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil && !errors.Is(err, localcert.ErrCacheMiss) {
+		return res.fail(classConfig, fmt.Sprintf("Error reading existing certificate %q", config.location(localcert.CacheKeyCertificate)), err)
 	}
 
-	var certDomain string
 	if cert != nil {
-		certDomain = cert.Subject.CommonName
-		fmt.Printf("Found existing certificate for domain %q\n", certDomain)
-		if !*flagForceRenew {
-			expiresIn := time.Until(cert.NotAfter)
-			if expiresIn > 30*24*time.Hour {
-				fmt.Println("Existing certificate expires in > 30 days and doesn't need to be renewed")
+		printLine("Found existing certificate for domain %q", cert.Subject.CommonName)
+		if !config.ForceRenew {
+			if !certHasRequestedNames(config, cert) {
+				printLine("Existing certificate names differ from requested names and will be renewed")
+			} else if !certHasRequestedKeyType(config, cert) {
+				printLine("Existing certificate key type differs from -keyType and will be renewed")
+			} else if renewAt, _ := renewalTime(ctx, client, cert, printLine); time.Now().Before(renewAt) {
+				printLine("Existing certificate isn't due for renewal until %s", renewAt.Format(time.RFC3339))
 				printCertInfo(config, cert)
-				os.Exit(0)
-			} else if expiresIn > 0 {
-				fmt.Println("Existing certificate expires in < 30 days and will be renewed")
+				res.setCertificate(cert)
+				return res.exit(exitNotDue)
+			} else if time.Now().Before(cert.NotAfter) {
+				printLine("Existing certificate is due for renewal and will be renewed")
 			} else {
-				fmt.Println("Existing certificate has expired and will be renewed")
+				printLine("Existing certificate has expired and will be renewed")
 			}
 		}
 	}
 
+	cert, err = renewCertificate(ctx, config, client, cert, printLine)
+	if err != nil {
+		return res.fail("", "Provisioning error", err)
+	}
+	return finishProvision(ctx, config, cert, res)
+}
+
+// finishProvision reports a newly provisioned certificate, writes exports
+// and runs deploy hooks, returning the exit code.
+func finishProvision(ctx context.Context, config *Config, cert *x509.Certificate, res *commandResult) int {
+	res.Renewed = true
+	res.setConfig(config)
+	res.setCertificate(cert)
+
+	printCertInfo(config, cert)
+
+	if err := runExports(ctx, config, printLine); err != nil {
+		return res.fail(classConfig, "Export error", err)
+	}
+	for _, e := range config.Exports {
+		res.Exports = append(res.Exports, e.path)
+	}
+
+	if err := runDeployHooks(config, cert, printLine); err != nil {
+		return res.fail(classHook, "Deploy hook error", err)
+	}
+	return res.exit(exitOK)
+}
+
+// renewCertificate runs the full registration and provisioning flow and
+// writes the resulting certificate chain. The existing certificate, if any,
+// is used to report domain changes and is marked as replaced for ARI.
+func renewCertificate(ctx context.Context, config *Config, client *localcert.Client, existing *x509.Certificate, logf func(string, ...interface{})) (*x509.Certificate, error) {
+	certKey, newKey, err := config.ReadOrGenerateCertificateKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("certificate key: %w", err)
+	}
+
 	termsRetry := false
 	for {
 		account, err := client.EnsureRegistration(ctx, config.ACME.AcceptedTerms, config.ACME.PrivateKey.KeyID)
 		if termsErr := (localcert.TermsNotAcceptedError{}); !termsRetry && errors.As(err, &termsErr) {
-			PromptRequireAcceptTerms(termsErr.URI)
+			if err := PromptRequireAcceptTerms(config, termsErr.URI); err != nil {
+				return nil, fmt.Errorf("registration: %w", err)
+			}
 			config.ACME.AcceptedTerms = termsErr.URI
 			termsRetry = true
 			continue
+		} else if errors.Is(err, localcert.ErrExternalAccountRequired) {
+			return nil, fmt.Errorf("registration: %w; pass -eabKeyId and -eabHmacKey from your CA", err)
 		} else if err != nil {
-			log.Fatal("Registration error: ", err)
+			return nil, fmt.Errorf("registration: %w", err)
 		}
 		config.ACME.PrivateKey.KeyID = account.URI
 		break
 	}
-	if err := config.WriteACMEAccountFile(); err != nil {
-		log.Fatalf("Error writing acmeAccount file %q: %v", config.ACMEAccountFile, err)
+	if err := config.WriteACMEAccount(ctx); err != nil {
+		return nil, fmt.Errorf("write acmeAccount %q: %w", config.location(localcert.CacheKeyACMEAccount), err)
 	}
 
-	domain, err := client.GetDomain()
+	domain, err := client.GetDomain(ctx)
 	if err != nil {
-		log.Fatal("Error getting localcert domain name: ", err)
+		return nil, fmt.Errorf("get localcert domain name: %w", err)
 	}
 
-	if certDomain != "" && certDomain != domain {
-		fmt.Print("The localcert server has assigned you a new domain!\n\n")
-		fmt.Printf("  Old domain: %q\n", certDomain)
-		fmt.Printf("  New domain: %q\n\n", domain)
+	if existing != nil && existing.Subject.CommonName != domain {
+		logf("The localcert server has assigned you a new domain!")
+		logf("  Old domain: %q", existing.Subject.CommonName)
+		logf("  New domain: %q", domain)
 	}
 
-	fmt.Printf("Provisioning domain %q...\n", domain)
-	order, err := client.ProvisionDomain(ctx, domain)
-	if err != nil {
-		log.Fatal("Error provisioning domain: ", err)
+	names := expandNames(config.Names, strings.TrimPrefix(domain, "*."))
+	if len(names) > 0 {
+		logf("Provisioning domain %q with names %q...", domain, names)
+	} else {
+		logf("Provisioning domain %q...", domain)
 	}
-
-	certKey, err := config.ReadOrGenerateCertificateKey()
+	// Mark the order as replacing the existing certificate for ARI, unless
+	// the domain changed.
+	var replaces *x509.Certificate
+	if existing != nil && existing.Subject.CommonName == domain {
+		replaces = existing
+	}
+	order, err := client.RenewDomain(ctx, replaces, domain, names...)
 	if err != nil {
-		log.Fatal("Certificate key error: ", err)
+		return nil, fmt.Errorf("provision domain: %w", err)
 	}
 
-	fmt.Printf("Domain provisioned; waiting for certificate generation...\n")
+	logf("Domain provisioned; waiting for certificate generation...")
 	certChain, err := client.GetCertificate(ctx, order, certKey)
 	if err != nil {
-		log.Fatal("Error fetching certificate: ", err)
+		return nil, fmt.Errorf("fetch certificate: %w", err)
 	}
-	cert, err = x509.ParseCertificate(certChain[0])
+	cert, err := x509.ParseCertificate(certChain[0])
 	if err != nil {
-		log.Fatal("Error parsing generated certificate: ", err)
+		return nil, fmt.Errorf("parse generated certificate: %w", err)
 	}
 
-	var buf bytes.Buffer
-	for _, certBytes := range certChain {
-		err := pem.Encode(&buf, &pem.Block{Type: certificatePEMType, Bytes: certBytes})
-		if err != nil {
-			log.Fatal("Error writing certificate: ", err)
-		}
+	if newKey {
+		err = config.WriteCertificateAndKey(ctx, certChain, certKey)
+	} else {
+		err = config.WriteCertificate(ctx, certChain)
 	}
-	err = os.WriteFile(config.CertificateFile, buf.Bytes(), filePerm)
 	if err != nil {
-		log.Fatal("Error writing certificate: ", err)
+		return nil, fmt.Errorf("write certificate: %w", err)
 	}
 
-	printCertInfo(config, cert)
+	return cert, nil
+}
+
+func printLine(format string, args ...interface{}) {
+	fmt.Fprintf(textOutput(), format+"\n", args...)
 }
 
 func printCertInfo(config *Config, cert *x509.Certificate) {
+	if jsonOutput() {
+		return
+	}
 	fmt.Print("\nCertificate expires ", cert.NotAfter, "\n\n")
+	if config.CertificateFile == "" {
+		fmt.Println("Certificate stored with: ", config.StorageHelper)
+		return
+	}
 	fmt.Println("Certificate (chain): ", config.CertificateFile)
 	fmt.Println("Certificate privkey: ", config.KeyFile)
 }
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/acmetest"
+)
+
+// newTestConfig returns a Config for srv with a new data directory, like
+// newConfig with default flags.
+func newTestConfig(t *testing.T, srv *acmetest.Server) *Config {
+	t.Helper()
+	config := &Config{
+		DataDir:          t.TempDir(),
+		ServerURL:        srv.URL,
+		ACMEDirectoryURL: srv.CA.DirectoryURL(),
+		AcceptTerms:      true,
+	}
+	if err := config.initStorage(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestProvision(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx := testContext(t)
+	config := newTestConfig(t, srv)
+
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision exit code = %d, want %d", code, exitOK)
+	}
+	first, err := config.ReadCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.Domain(config.ACME.PrivateKey.KeyID); first.Subject.CommonName != want {
+		t.Errorf("certificate domain = %q, want %q", first.Subject.CommonName, want)
+	}
+	if _, err := os.Stat(config.KeyFile); err != nil {
+		t.Errorf("key file: %v", err)
+	}
+
+	if code := provision(ctx, config); code != exitNotDue {
+		t.Fatalf("second provision exit code = %d, want %d", code, exitNotDue)
+	}
+	if issued := len(srv.CA.Issued()); issued != 1 {
+		t.Fatalf("CA issued %d certificates, want 1", issued)
+	}
+
+	config.ForceRenew = true
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("forced provision exit code = %d, want %d", code, exitOK)
+	}
+	forced, err := config.ReadCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forced.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("forced renewal kept the existing certificate")
+	}
+	if !srv.CA.Replaced(first) {
+		t.Error("forced renewal didn't replace the existing certificate")
+	}
+}
+
+func TestProvisionNamesAndExports(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx := testContext(t)
+	config := newTestConfig(t, srv)
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision exit code = %d, want %d", code, exitOK)
+	}
+
+	pemFile := filepath.Join(t.TempDir(), "fullchain.pem")
+	config.Names = []string{"*.api", "@"}
+	config.Exports = []export{{format: "pem", path: pemFile}}
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision with names exit code = %d, want %d", code, exitOK)
+	}
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := cert.Subject.CommonName
+	base := domain[len("*."):]
+	if want := []string{domain, "*.api." + base, base}; !reflect.DeepEqual(cert.DNSNames, want) {
+		t.Errorf("names = %q, want %q", cert.DNSNames, want)
+	}
+	if _, err := os.Stat(pemFile); err != nil {
+		t.Errorf("export: %v", err)
+	}
+
+	if code := provision(ctx, config); code != exitNotDue {
+		t.Errorf("second provision exit code = %d, want %d", code, exitNotDue)
+	}
+}
+
+func TestProvisionRenewalWindow(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx := testContext(t)
+	config := newTestConfig(t, srv)
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision exit code = %d, want %d", code, exitOK)
+	}
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the CA asking for early renewal.
+	now := time.Now()
+	window := localcert.RenewalWindow{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)}
+	if err := srv.CA.SetRenewalWindow(cert, window); err != nil {
+		t.Fatal(err)
+	}
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision in renewal window exit code = %d, want %d", code, exitOK)
+	}
+	if !srv.CA.Replaced(cert) {
+		t.Error("renewal didn't replace the existing certificate")
+	}
+}
+
+func TestProvisionTerms(t *testing.T) {
+	const terms = "https://ca.test/terms/v1"
+	srv := acmetest.NewServer(acmetest.ServerConfig{CA: acmetest.Config{TermsOfService: terms}})
+	defer srv.Close()
+	ctx := testContext(t)
+	config := newTestConfig(t, srv)
+
+	// Without a terminal the terms can't be accepted interactively.
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdin := os.Stdin
+	os.Stdin = devNull
+	t.Cleanup(func() { os.Stdin = stdin })
+
+	config.AcceptTerms = false
+	if code := provision(ctx, config); code != exitTerms {
+		t.Fatalf("provision without accepting terms exit code = %d, want %d", code, exitTerms)
+	}
+	if _, err := config.Storage.Get(ctx, localcert.CacheKeyACMEAccount); !errors.Is(err, localcert.ErrCacheMiss) {
+		t.Errorf("account stored without accepting terms: %v", err)
+	}
+
+	config.AcceptTerms = true
+	if code := provision(ctx, config); code != exitOK {
+		t.Fatalf("provision accepting terms exit code = %d, want %d", code, exitOK)
+	}
+	if config.ACME.AcceptedTerms != terms {
+		t.Errorf("accepted terms = %q, want %q", config.ACME.AcceptedTerms, terms)
+	}
+
+	// The accepted terms are stored with the account.
+	config.AcceptTerms = false
+	config.ForceRenew = true
+	if code := provision(ctx, config); code != exitOK {
+		t.Errorf("provision with accepted terms exit code = %d, want %d", code, exitOK)
+	}
+}
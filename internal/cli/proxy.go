@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// fallbackRoute is the route name used for hosts without their own route.
+const fallbackRoute = "*"
+
+var (
+	flagProxyPort = flag.Int("proxyPort", 8443, "port for TLS proxy")
+	flagRoutes    = routesFlag{}
+)
+
+func init() {
+	flag.Var(flagRoutes, "route", "proxy route `name=backend`, e.g. api=localhost:3000 (repeatable; name * matches any host)")
+}
+
+// routesFlag maps subdomain names to backend URLs.
+type routesFlag map[string]*url.URL
+
+func (rf routesFlag) String() string {
+	var routes []string
+	for name, backend := range rf {
+		routes = append(routes, name+"="+backend.String())
+	}
+	sort.Strings(routes)
+	return strings.Join(routes, ",")
+}
+
+func (rf routesFlag) Set(value string) error {
+	name, backend := splitRoute(value)
+	if name == "" || backend == "" {
+		return fmt.Errorf("invalid route %q; expected name=backend", value)
+	}
+	if !strings.Contains(backend, "://") {
+		backend = "http://" + backend
+	}
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return fmt.Errorf("invalid route backend %q: %w", backend, err)
+	}
+	rf[strings.ToLower(name)] = backendURL
+	return nil
+}
+
+func splitRoute(value string) (string, string) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// Proxy serves a TLS-terminating reverse proxy that routes requests for
+// <name>.<domain> to the backend for name.
+func Proxy() int {
+	res := newResult("proxy")
+	if len(flagRoutes) == 0 {
+		return res.fail(classConfig, "Error", errors.New("at least one -route is required, e.g. -route api=localhost:3000"))
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	config, err := GetConfig(ctx)
+	if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	res.setConfig(config)
+
+	l, reloader, err := listenTLS(ctx, config, *flagProxyPort)
+	if err != nil {
+		return res.fail("", "Error", err)
+	}
+	res.setCertificate(reloader.Leaf())
+
+	proxies := make(map[string]*httputil.ReverseProxy)
+	res.Routes = make(map[string]string)
+	for name, backend := range flagRoutes {
+		proxies[name] = newReverseProxy(backend)
+		host := name + "." + reloader.Domain()
+		if name == fallbackRoute {
+			host = "<any>." + reloader.Domain()
+		}
+		hostURL := fmt.Sprintf("https://%s:%d", host, *flagProxyPort)
+		res.Routes[hostURL] = backend.String()
+		printLine("%s -> %s", hostURL, backend)
+	}
+	res.print()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := routeName(r, reloader.Domain())
+		proxy, ok := proxies[name]
+		if !ok {
+			proxy, ok = proxies[fallbackRoute]
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("no route for %q", name), http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+	if err := serveTLS(ctx, l, handler); err != nil {
+		return res.fail("", "Proxy error", err)
+	}
+	return exitOK
+}
+
+// routeName returns the subdomain of domain that r is for, from the Host
+// header or else the TLS server name.
+func routeName(r *http.Request, domain string) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.TrimSuffix(host, "."+domain)
+}
+
+func newReverseProxy(backend *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Proxy error for %s%s: %v", r.Host, r.URL.Path, err)
+		http.Error(w, fmt.Sprintf("backend %s unavailable", backend.Host), http.StatusBadGateway)
+	}
+	return proxy
+}
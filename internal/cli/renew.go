@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/lann/localcert"
+)
+
+const (
+	minRenewWait     = time.Minute
+	initialBackoff   = time.Minute
+	renewJitterRatio = 0.25
+
+	// renewalInfoInterval is how often renewal info is checked if the ACME
+	// server doesn't say.
+	renewalInfoInterval = 6 * time.Hour
+)
+
+var (
+	flagDaemon        = flag.Bool("daemon", false, "keep running and renew the certificate when it is due")
+	flagRenewInterval = flag.Duration("renewInterval", 12*time.Hour, "how often the renewal daemon checks the certificate")
+)
+
+// Renew renews the certificate if it is due, with the flags, once or with
+// -daemon until interrupted, returning the exit code.
+func Renew() int {
+	ctx, stop := signalContext()
+	defer stop()
+
+	config, err := newConfig()
+	if err != nil {
+		return newResult("renew").fail(classConfig, "Config error", err)
+	}
+	return renew(ctx, config)
+}
+
+func renew(ctx context.Context, config *Config) int {
+	res := newResult("renew")
+	res.setConfig(config)
+
+	if !config.Daemon {
+		attemptCtx, cancel := withTimeout(ctx, config.Timeout)
+		defer cancel()
+		r, err := renewLocked(attemptCtx, config)
+		if err != nil {
+			return res.fail("", "Renewal error", err)
+		}
+		res.Renewed = r.renewed
+		res.setConfig(config)
+		res.setCertificate(r.cert)
+		if !r.renewed {
+			return res.exit(exitNotDue)
+		}
+		return res.exit(exitOK)
+	}
+
+	interval := config.RenewInterval
+	if interval < minRenewWait {
+		return res.fail(classConfig, "Config error", fmt.Errorf("invalid -renewInterval %s; must be at least %s", interval, minRenewWait))
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	log.Printf("Starting renewal daemon; checking every ~%s", interval)
+
+	var backoff time.Duration
+	for {
+		wait := jitter(rnd, interval)
+
+		attemptCtx, cancel := withTimeout(ctx, config.Timeout)
+		r, err := renewLocked(attemptCtx, config)
+		cancel()
+		if err != nil {
+			backoff = nextBackoff(backoff, interval)
+			log.Printf("Renewal failed: %v", err)
+			wait = jitter(rnd, backoff)
+		} else {
+			backoff = 0
+			if untilDue := time.Until(r.next); untilDue < wait {
+				wait = untilDue
+			}
+		}
+		if wait < minRenewWait {
+			wait = minRenewWait
+		}
+
+		log.Printf("Next check in %s", wait.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			log.Print("Renewal daemon stopping")
+			return exitOK
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewLocked locks the data directory, reloads the stored state and
+// renews the certificate if due. The daemon holds the lock only while
+// checking and renewing, so other commands can run in between.
+func renewLocked(ctx context.Context, config *Config) (*renewal, error) {
+	unlock, err := config.lockAndLoad(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return renewIfDue(ctx, config, config.Client())
+}
+
+// renewal is the result of renewIfDue.
+type renewal struct {
+	cert    *x509.Certificate
+	renewed bool
+
+	// next is when the certificate is due for renewal, or when to check its
+	// renewal info again if that is sooner.
+	next time.Time
+}
+
+// renewIfDue renews the certificate if it is missing or due for renewal,
+// returning the current (possibly new) certificate.
+func renewIfDue(ctx context.Context, config *Config, client *localcert.Client) (*renewal, error) {
+	cert, err := config.ReadCertificate(ctx)
+	if errors.Is(err, localcert.ErrCacheMiss) {
+		log.Print("No existing certificate found; provisioning")
+	} else if err != nil {
+		return nil, fmt.Errorf("read certificate %q: %w", config.location(localcert.CacheKeyCertificate), err)
+	} else if !certHasRequestedNames(config, cert) {
+		log.Printf("Certificate names %q differ from requested names; renewing", cert.DNSNames)
+	} else if !certHasRequestedKeyType(config, cert) {
+		log.Printf("Certificate key type differs from -keyType; renewing")
+	} else if renewAt, checkAfter := renewalTime(ctx, client, cert, log.Printf); time.Now().Before(renewAt) {
+		log.Printf("Certificate for %q expires %s; not due for renewal until %s",
+			cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339), renewAt.Format(time.RFC3339))
+		return &renewal{cert: cert, next: nextCheck(renewAt, checkAfter)}, nil
+	} else {
+		log.Printf("Certificate for %q expires %s; renewing", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	cert, err = renewCertificate(ctx, config, client, cert, log.Printf)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Stored new certificate for %q; expires %s",
+		cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+
+	// Export and hook failures are reported but shouldn't trigger another
+	// renewal.
+	if err := runExports(ctx, config, log.Printf); err != nil {
+		log.Printf("Export error: %v", err)
+	}
+	_ = runDeployHooks(config, cert, log.Printf)
+
+	renewAt, checkAfter := renewalTime(ctx, client, cert, log.Printf)
+	return &renewal{cert: cert, renewed: true, next: nextCheck(renewAt, checkAfter)}, nil
+}
+
+// renewalTime returns when cert is due for renewal: a time within the ACME
+// server's suggested renewal window (ARI) if it supports ARI, and otherwise
+// renewBefore its expiry. With ARI, checkAfter is when to fetch the
+// suggested window again, as it can change, e.g. after a CA incident.
+func renewalTime(ctx context.Context, client *localcert.Client, cert *x509.Certificate, logf func(string, ...interface{})) (renewAt time.Time, checkAfter time.Duration) {
+	fallback := cert.NotAfter.Add(-renewBefore)
+	info, err := client.GetRenewalInfo(ctx, cert)
+	if errors.Is(err, localcert.ErrRenewalInfoUnsupported) {
+		return fallback, 0
+	} else if err != nil {
+		logf("Couldn't get renewal info; renewing %s before expiry: %v", renewBefore, err)
+		return fallback, renewalInfoInterval
+	}
+	if info.ExplanationURL != "" {
+		logf("The ACME server suggests renewing between %s and %s: %s",
+			info.SuggestedWindow.Start.Format(time.RFC3339), info.SuggestedWindow.End.Format(time.RFC3339), info.ExplanationURL)
+	}
+	checkAfter = info.RetryAfter
+	if checkAfter <= 0 {
+		checkAfter = renewalInfoInterval
+	}
+	return info.RenewalTime(), checkAfter
+}
+
+// nextCheck returns the earlier of renewAt and checkAfter from now, if set.
+func nextCheck(renewAt time.Time, checkAfter time.Duration) time.Time {
+	if checkAfter > 0 && time.Now().Add(checkAfter).Before(renewAt) {
+		return time.Now().Add(checkAfter)
+	}
+	return renewAt
+}
+
+// jitter returns a random duration within renewJitterRatio of d.
+func jitter(rnd *rand.Rand, d time.Duration) time.Duration {
+	spread := float64(d) * renewJitterRatio
+	return d + time.Duration((rnd.Float64()*2-1)*spread)
+}
+
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff == 0 {
+		backoff = initialBackoff
+	} else {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/acmetest"
+)
+
+func TestRenew(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	ctx := testContext(t)
+	config := newTestConfig(t, srv)
+
+	if code := renew(ctx, config); code != exitOK {
+		t.Fatalf("renew without a certificate exit code = %d, want %d", code, exitOK)
+	}
+	if code := renew(ctx, config); code != exitNotDue {
+		t.Fatalf("renew before due exit code = %d, want %d", code, exitNotDue)
+	}
+
+	cert, err := config.ReadCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	window := localcert.RenewalWindow{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)}
+	if err := srv.CA.SetRenewalWindow(cert, window); err != nil {
+		t.Fatal(err)
+	}
+	if code := renew(ctx, config); code != exitOK {
+		t.Fatalf("renew when due exit code = %d, want %d", code, exitOK)
+	}
+	if !srv.CA.Replaced(cert) {
+		t.Error("renewal didn't replace the existing certificate")
+	}
+	if issued := len(srv.CA.Issued()); issued != 2 {
+		t.Errorf("CA issued %d certificates, want 2", issued)
+	}
+}
+
+func TestRenewDaemonInterval(t *testing.T) {
+	srv := acmetest.NewServer(acmetest.ServerConfig{})
+	defer srv.Close()
+	config := newTestConfig(t, srv)
+	config.Daemon = true
+	config.RenewInterval = time.Second
+	if code := renew(testContext(t), config); code != exitConfig {
+		t.Errorf("renew with short interval exit code = %d, want %d", code, exitConfig)
+	}
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	flagRevokeReason = flag.String("reason", "unspecified", "revocation reason for revoke: unspecified, keyCompromise, affiliationChanged, superseded or cessationOfOperation, or its RFC 5280 code")
+	flagRevokeWith   = flag.String("revokeWith", "account", "key that signs the revocation request: account or certificate")
+	flagReprovision  = flag.Bool("reprovision", false, "after revoking, provision a new certificate with a new key")
+)
+
+// revocationReasons are the RFC 5280 CRLReason names that ACME CAs such
+// as Let's Encrypt accept from subscribers. The others are for CAs' own
+// use, and certificateHold and removeFromCRL don't apply to permanent
+// revocation.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+}
+
+// parseRevocationReason parses a reason name, case-insensitively, or code.
+func parseRevocationReason(value string) (name string, reason acme.CRLReasonCode, err error) {
+	code, numErr := strconv.Atoi(value)
+	for name, reason := range revocationReasons {
+		if strings.EqualFold(name, value) || (numErr == nil && int(reason) == code) {
+			return name, reason, nil
+		}
+	}
+	var names []string
+	for name := range revocationReasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "", 0, fmt.Errorf("invalid -reason %q; expected one of %s", value, strings.Join(names, ", "))
+}
+
+// revocation describes a revoked certificate in commandResult.
+type revocation struct {
+	Domain string `json:"domain"`
+	Serial string `json:"serial"`
+	Reason string `json:"reason"`
+}
+
+// Revoke revokes the stored certificate and, with -reprovision, replaces it
+// with a new certificate and key.
+func Revoke() int {
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+
+	res := newResult("revoke")
+	config, unlock, err := GetLockedConfig(ctx)
+	if errors.Is(err, errLocked) {
+		return res.fail(classLocked, "Error", err)
+	} else if err != nil {
+		return res.fail(classConfig, "Config error", err)
+	}
+	defer unlock()
+	res.setConfig(config)
+
+	reasonName, reason, err := parseRevocationReason(*flagRevokeReason)
+	if err != nil {
+		return res.fail(classConfig, "Error", err)
+	}
+	cert, certKey, err := readCertificateToRevoke(ctx, config)
+	if err != nil {
+		return res.fail(classConfig, "Error reading certificate", err)
+	}
+	res.setCertificate(cert)
+
+	err = confirm(fmt.Sprintf("Revoke the certificate for %q (serial %x, expires %s) for reason %s? It can't be undone.",
+		cert.Subject.CommonName, cert.SerialNumber, cert.NotAfter, reasonName),
+		"revoking the certificate requires confirmation; pass -yes")
+	if err != nil {
+		return res.fail("", "Error", err)
+	}
+
+	client := config.Client()
+	if err := client.RevokeCertificate(ctx, cert.Raw, certKey, reason); err != nil {
+		return res.fail("", "Revocation error", err)
+	}
+	res.Revoked = &revocation{
+		Domain: cert.Subject.CommonName,
+		Serial: fmt.Sprintf("%x", cert.SerialNumber),
+		Reason: reasonName,
+	}
+	printLine("Revoked certificate for %q (serial %x)", cert.Subject.CommonName, cert.SerialNumber)
+
+	if !*flagReprovision {
+		printLine("The revoked certificate is still stored; run `localcert -forceRenew -rotateKey` to replace it")
+		return res.exit(exitOK)
+	}
+
+	// Never reuse the key of a revoked certificate, which may have leaked.
+	config.RotateKey = true
+	cert, err = renewCertificate(ctx, config, client, cert, printLine)
+	if err != nil {
+		return res.fail("", "Provisioning error", err)
+	}
+	return finishProvision(ctx, config, cert, res)
+}
+
+// readCertificateToRevoke reads the stored certificate and, with
+// -revokeWith certificate, its key to sign the request. The key is nil for
+// -revokeWith account.
+func readCertificateToRevoke(ctx context.Context, config *Config) (*x509.Certificate, crypto.Signer, error) {
+	switch *flagRevokeWith {
+	case "account":
+		cert, err := config.ReadCertificate(ctx)
+		return cert, nil, err
+	case "certificate":
+		// ReadTLSCertificate checks that the key matches the certificate.
+		tlsCert, err := config.ReadTLSCertificate(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		certKey, ok := tlsCert.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid certificate key type %T", tlsCert.PrivateKey)
+		}
+		return cert, certKey, nil
+	}
+	return nil, nil, fmt.Errorf("invalid -revokeWith %q; expected account or certificate", *flagRevokeWith)
+}
@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		name  string
+		want  acme.CRLReasonCode
+	}{
+		{"unspecified", "unspecified", acme.CRLReasonUnspecified},
+		{"KeyCompromise", "keyCompromise", acme.CRLReasonKeyCompromise},
+		{"1", "keyCompromise", acme.CRLReasonKeyCompromise},
+		{"5", "cessationOfOperation", acme.CRLReasonCessationOfOperation},
+	} {
+		name, reason, err := parseRevocationReason(tc.value)
+		if err != nil {
+			t.Errorf("parseRevocationReason(%q): %v", tc.value, err)
+		} else if name != tc.name || reason != tc.want {
+			t.Errorf("parseRevocationReason(%q) = %q, %v; want %q, %v", tc.value, name, reason, tc.name, tc.want)
+		}
+	}
+
+	// ACME CAs reject these from subscribers.
+	for _, value := range []string{"certificateHold", "6", "removeFromCRL", "8", "cACompromise", "privilegeWithdrawn", "aACompromise", "bogus"} {
+		if _, _, err := parseRevocationReason(value); err == nil {
+			t.Errorf("parseRevocationReason(%q) succeeded", value)
+		}
+	}
+}
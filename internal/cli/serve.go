@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	certReloadInterval = time.Minute
+	shutdownTimeout    = 5 * time.Second
+)
+
+// certReloader serves the stored certificate, reloading it periodically so
+// that renewals are picked up without a restart.
+type certReloader struct {
+	config *Config
+
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	loaded time.Time
+}
+
+func newCertReloader(ctx context.Context, config *Config) (*certReloader, error) {
+	r := &certReloader{config: config}
+	if err := r.reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Domain returns the base domain of the certificate, without the "*.".
+func (r *certReloader) Domain() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.TrimPrefix(r.leaf.Subject.CommonName, "*.")
+}
+
+// Leaf returns the parsed certificate.
+func (r *certReloader) Leaf() *x509.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaf
+}
+
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	stale := time.Since(r.loaded) > certReloadInterval
+	r.mu.Unlock()
+	if stale {
+		if err := r.reload(hello.Context()); err != nil {
+			log.Printf("Error reloading certificate; using previous: %v", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) reload(ctx context.Context) error {
+	cert, err := r.config.ReadTLSCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leaf != nil && !leaf.Equal(r.leaf) {
+		log.Printf("Loaded renewed certificate; expires %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	r.cert, r.leaf, r.loaded = &cert, leaf, time.Now()
+	return nil
+}
+
+// listenTLS listens on port with the stored certificate, reloading it after
+// renewals.
+func listenTLS(ctx context.Context, config *Config, port int) (net.Listener, *certReloader, error) {
+	reloader, err := newCertReloader(ctx, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read certificate: %w", err)
+	}
+	addr := fmt.Sprintf(":%d", port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen to %s: %w", addr, err)
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}), reloader, nil
+}
+
+// serveTLS serves handler on a listener from listenTLS until ctx is done,
+// then shuts down gracefully.
+func serveTLS(ctx context.Context, l net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/internal/fileutil"
+)
+
+// fileStorage is a localcert.Cache that stores each key in the file
+// configured for it, so that e.g. -localCert can point anywhere. Keys with
+// a suffix, like "cert.pem.prev", are stored next to their base key's file.
+type fileStorage map[string]string
+
+var _ localcert.Cache = fileStorage(nil)
+
+func (fs fileStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, localcert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (fs fileStorage) Put(ctx context.Context, key string, data []byte) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data, filePerm)
+}
+
+func (fs fileStorage) Delete(ctx context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (fs fileStorage) path(key string) (string, error) {
+	if path, ok := fs[key]; ok {
+		return path, nil
+	}
+	for base, path := range fs {
+		if strings.HasPrefix(key, base+".") {
+			return path + strings.TrimPrefix(key, base), nil
+		}
+	}
+	return "", fmt.Errorf("no file for %q", key)
+}
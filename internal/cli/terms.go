@@ -8,39 +8,44 @@ import (
 	"strings"
 
 	"github.com/mattn/go-isatty"
+
+	"github.com/lann/localcert"
 )
 
 var flagAcceptTerms = flag.Bool("acceptTerms", false, "accept ACME provider's terms of service")
 
-func PromptRequireAcceptTerms(termsURI string) {
-	if !*flagAcceptTerms {
-		fmt.Println()
-		fmt.Println("######################################################")
-		fmt.Println("The ACME provder you are registering with requires acceptance of these terms of service:")
-		fmt.Println(termsURI)
+// PromptRequireAcceptTerms asks the user to accept the ACME provider's terms
+// of service at termsURI, unless config.AcceptTerms is set. It returns a
+// localcert.TermsNotAcceptedError if they aren't accepted.
+func PromptRequireAcceptTerms(config *Config, termsURI string) error {
+	if config.AcceptTerms {
+		return nil
+	}
+	termsErr := localcert.TermsNotAcceptedError{URI: termsURI}
+	if jsonOutput() || !isatty.IsTerminal(os.Stdin.Fd()) {
+		// Don't prompt; the error reports the terms URI.
+		return fmt.Errorf("terms of service %s not accepted; run this command in a terminal or pass -acceptTerms: %w", termsURI, termsErr)
+	}
 
-		if isatty.IsTerminal(os.Stdin.Fd()) {
-			stdin := bufio.NewReader(os.Stdin)
-			for {
-				fmt.Print("Do you agree? (Y)es/(N)o: ")
-				ans, err := stdin.ReadString('\n')
-				if err != nil {
-					fmt.Print("Error getting prompt response: ", err)
-					os.Exit(2)
-				}
-				switch strings.ToLower(strings.TrimSpace(ans)) {
-				case "y", "yes":
-					fmt.Println("######################################################")
-					fmt.Println()
-					return
-				case "n", "no":
-					fmt.Print("Terms rejected; exiting...")
-					os.Exit(1)
-				}
-			}
-		} else {
-			fmt.Println("You can run this command in a supported terminal or pass the -acceptTerms flag.")
-			os.Exit(1)
+	fmt.Println()
+	fmt.Println("######################################################")
+	fmt.Println("The ACME provder you are registering with requires acceptance of these terms of service:")
+	fmt.Println(termsURI)
+
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Do you agree? (Y)es/(N)o: ")
+		ans, err := stdin.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("prompt: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(ans)) {
+		case "y", "yes":
+			fmt.Println("######################################################")
+			fmt.Println()
+			return nil
+		case "n", "no":
+			return fmt.Errorf("terms of service %s rejected: %w", termsURI, termsErr)
 		}
 	}
 }
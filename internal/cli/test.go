@@ -4,59 +4,62 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net"
 	"net/http"
-	"strings"
-	"sync"
 )
 
 var flagTestPort = flag.Int("testPort", 8443, "port for test server")
 
-func Test() {
+func Test() int {
+	ctx, stop := signalContext()
+	defer stop()
 
-	config, err := GetConfig()
+	res := newResult("test")
+	config, err := GetConfig(ctx)
 	if err != nil {
-		log.Fatal("Config error: ", err)
+		return res.fail(classConfig, "Config error", err)
 	}
+	res.setConfig(config)
 
-	cert, err := config.ReadCertificate()
+	l, reloader, err := listenTLS(ctx, config, *flagTestPort)
 	if err != nil {
-		log.Fatal("Error reading certificate: ", err)
+		return res.fail("", "Error", err)
 	}
-	domain := strings.TrimPrefix(cert.Subject.CommonName, "*.")
-	url := fmt.Sprintf("https://localhost.%s:%d", domain, *flagTestPort)
-	fmt.Print("Serving test page at:\n\n", url, "\n\n")
+	url := fmt.Sprintf("https://localhost.%s:%d", reloader.Domain(), *flagTestPort)
+	res.URL = url
+	printLine("Serving test page at:\n\n%s\n", url)
 
-	http.HandleFunc("/", handleTest)
-	addr := fmt.Sprintf(":%d", *flagTestPort)
-
-	var wg sync.WaitGroup
-	wg.Add(1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleTest)
+	serveErr := make(chan error, 1)
 	go func() {
-		l, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatalf("Error listening to %s: %v", addr, err)
-		}
-		wg.Done()
-		log.Fatal(http.ServeTLS(l, nil, config.CertificateFile, config.KeyFile))
+		serveErr <- serveTLS(ctx, l, mux)
 	}()
-	wg.Wait()
 
-	fmt.Println("Sending self-test request...")
-	resp, err := http.Get(url)
+	printLine("Sending self-test request...")
+	reqCtx, cancel := withTimeout(ctx, *flagTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return res.fail("", "Error", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatal("Error: ", err)
+		return res.fail("", "Error", err)
 	}
 	body, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		log.Fatal("Error reading response body: ", err)
+		return res.fail("", "Error reading response body", err)
 	}
-	fmt.Printf("Response: %q\n\n", body)
+	printLine("Response: %q\n", body)
+	res.setCertificate(reloader.Leaf())
+	res.print()
 
-	fmt.Println("You can test in a browser now or Ctrl-C to exit.")
-	<-(chan struct{})(nil)
+	printLine("You can test in a browser now or Ctrl-C to exit.")
+	if err := <-serveErr; err != nil {
+		return res.fail("", "Server error", err)
+	}
+	return exitOK
 }
 
 func handleTest(w http.ResponseWriter, r *http.Request) {
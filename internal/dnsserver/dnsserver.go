@@ -0,0 +1,169 @@
+// Package dnsserver implements an authoritative DNS server for a localcert
+// zone.
+package dnsserver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/lann/localcert/internal/iplabel"
+)
+
+const (
+	defaultTTL = 300
+	// challengeTTL is short so that new challenge records are seen quickly.
+	challengeTTL = 10
+
+	challengeLabel = "_acme-challenge"
+)
+
+// TXTLookup looks up published dns-01 challenge records.
+type TXTLookup interface {
+	LookupTXT(name string) []string
+}
+
+type Config struct {
+	// Zone is the zone served, e.g. "user.localcert.dev".
+	Zone string
+
+	// Nameservers are the NS records for the zone.
+	Nameservers []string
+
+	// Hostmaster is the SOA responsible mailbox, e.g. "hostmaster.localcert.dev".
+	Hostmaster string
+
+	// TXT looks up challenge records.
+	TXT TXTLookup
+}
+
+// Handler is a dns.Handler answering for:
+//
+//	<zone>                            SOA, NS
+//	localhost.<id>.<zone>             A 127.0.0.1
+//	ip10-11-12-13.<id>.<zone>         A 10.11.12.13
+//	ip6-fd00--1.<id>.<zone>           AAAA fd00::1
+//	_acme-challenge.<id>.<zone>       TXT (pending challenges)
+type Handler struct {
+	zone        string
+	nameservers []string
+	hostmaster  string
+	txt         TXTLookup
+}
+
+var _ dns.Handler = (*Handler)(nil)
+
+func New(config Config) *Handler {
+	h := &Handler{
+		zone:       dns.CanonicalName(config.Zone),
+		hostmaster: dns.CanonicalName(config.Hostmaster),
+		txt:        config.TXT,
+	}
+	for _, ns := range config.Nameservers {
+		h.nameservers = append(h.nameservers, dns.CanonicalName(ns))
+	}
+	if h.hostmaster == "." {
+		h.hostmaster = "hostmaster." + h.zone
+	}
+	return h
+}
+
+func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		msg.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(msg)
+		return
+	}
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	if q.Qclass != dns.ClassINET || !dns.IsSubDomain(h.zone, name) {
+		msg.Authoritative = false
+		msg.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+
+	answers, exists := h.answer(name, q.Qtype)
+	if !exists {
+		msg.Rcode = dns.RcodeNameError
+	}
+	msg.Answer = answers
+	if len(answers) == 0 {
+		// NXDOMAIN or NODATA
+		msg.Ns = []dns.RR{h.soa()}
+	}
+	w.WriteMsg(msg)
+}
+
+// answer returns the answers for name and qtype, and whether name exists.
+func (h *Handler) answer(name string, qtype uint16) ([]dns.RR, bool) {
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, h.zone))
+	switch len(labels) {
+	case 0:
+		switch qtype {
+		case dns.TypeSOA:
+			return []dns.RR{h.soa()}, true
+		case dns.TypeNS:
+			return h.ns(), true
+		}
+		return nil, true
+	case 1:
+		// <id>.<zone> has no records of its own, but subdomains exist.
+		return nil, true
+	}
+
+	if labels[0] == challengeLabel {
+		values := h.txt.LookupTXT(name)
+		if qtype != dns.TypeTXT || len(values) == 0 {
+			return nil, len(labels) == 2 || len(values) > 0
+		}
+		return []dns.RR{&dns.TXT{Hdr: h.header(name, dns.TypeTXT, challengeTTL), Txt: values}}, true
+	}
+
+	if len(labels) != 2 {
+		return nil, false
+	}
+	ip := iplabel.Parse(labels[0])
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+		return []dns.RR{&dns.A{Hdr: h.header(name, dns.TypeA, defaultTTL), A: ip4}}, true
+	} else if ip4 == nil && qtype == dns.TypeAAAA {
+		return []dns.RR{&dns.AAAA{Hdr: h.header(name, dns.TypeAAAA, defaultTTL), AAAA: ip}}, true
+	}
+	return nil, true
+}
+
+func (h *Handler) header(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
+
+func (h *Handler) soa() dns.RR {
+	ns := h.zone
+	if len(h.nameservers) > 0 {
+		ns = h.nameservers[0]
+	}
+	return &dns.SOA{
+		Hdr:     h.header(h.zone, dns.TypeSOA, defaultTTL),
+		Ns:      ns,
+		Mbox:    h.hostmaster,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  challengeTTL,
+	}
+}
+
+func (h *Handler) ns() []dns.RR {
+	var rrs []dns.RR
+	for _, ns := range h.nameservers {
+		rrs = append(rrs, &dns.NS{Hdr: h.header(h.zone, dns.TypeNS, defaultTTL), Ns: ns})
+	}
+	return rrs
+}
@@ -0,0 +1,52 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock.
+var ErrLocked = errors.New("locked by another process")
+
+// Lock is an advisory, exclusive lock on a file, held until Unlock or until
+// the process exits.
+type Lock struct {
+	f *os.File
+}
+
+// TryLock acquires the lock on name, creating the file if needed, and
+// writes the current process ID to it. It returns an error wrapping
+// ErrLocked, with the holder's process ID if known, if another process
+// holds the lock.
+func TryLock(name string) (*Lock, error) {
+	f, err := tryLockFile(name)
+	if errors.Is(err, ErrLocked) {
+		if pid := readLockPID(name); pid != 0 {
+			return nil, fmt.Errorf("%w (pid %d)", ErrLocked, pid)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	return unlockFile(l.f)
+}
+
+func readLockPID(name string) int {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func tryLockFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return nil, ErrLocked
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockFile releases the lock by closing f. The lock file is left in
+// place; removing it could race with another process locking it.
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package fileutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Without flock, the lock is the existence of the file. A lock left by a
+// crashed process must be removed by hand.
+func tryLockFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrLocked
+	}
+	return f, err
+}
+
+func unlockFile(f *os.File) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
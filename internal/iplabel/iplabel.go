@@ -0,0 +1,95 @@
+// Package iplabel implements the localcert hostname labels that encode IP
+// addresses, e.g. "localhost", "ip10-11-12-13" and "ip6-fd00--1".
+//
+// IPv6 labels replace each ':' with '-'. Since labels can't end with '-', an
+// address ending in "::" is written with a trailing zero, e.g. "ip6-fd00--0".
+// Zone IDs can't be encoded.
+package iplabel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	localhostLabel = "localhost"
+	ipv4Prefix     = "ip"
+	ipv6Prefix     = "ip6-"
+)
+
+// allowedNets are the reserved address blocks that labels may encode.
+var allowedNets = mustParseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // private networks
+	"169.254.0.0/16", // link-local addresses
+	"127.0.0.0/8",    // loopback addresses
+	"fc00::/7",       // IPv6 unique local addresses
+	"fe80::/10",      // IPv6 link-local addresses
+	"::1/128",        // IPv6 loopback address
+)
+
+// Parse returns the IP address encoded by label, or nil if label doesn't
+// encode an allowed address.
+func Parse(label string) net.IP {
+	label = strings.ToLower(label)
+	if label == localhostLabel {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	if strings.HasPrefix(label, ipv6Prefix) {
+		ip := net.ParseIP(strings.ReplaceAll(strings.TrimPrefix(label, ipv6Prefix), "-", ":"))
+		if ip == nil || ip.To4() != nil || !Allowed(ip) {
+			return nil
+		}
+		return ip
+	}
+	if !strings.HasPrefix(label, ipv4Prefix) {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(label, ipv4Prefix), "-")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := net.ParseIP(strings.Join(parts, "."))
+	if ip == nil || ip.To4() == nil || !Allowed(ip) {
+		return nil
+	}
+	return ip
+}
+
+// Format returns the label encoding ip.
+func Format(ip net.IP) (string, error) {
+	if !Allowed(ip) {
+		return "", fmt.Errorf("%s is not in an allowed address block", ip)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ipv4Prefix + strings.ReplaceAll(ip4.String(), ".", "-"), nil
+	}
+	label := strings.ReplaceAll(ip.String(), ":", "-")
+	if strings.HasSuffix(label, "-") {
+		label += "0"
+	}
+	return ipv6Prefix + label, nil
+}
+
+// Allowed reports whether ip is in one of the reserved address blocks that
+// labels may encode.
+func Allowed(ip net.IP) bool {
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
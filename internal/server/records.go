@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TXTRecords publishes dns-01 challenge records.
+type TXTRecords interface {
+	AddTXT(ctx context.Context, name, value string) error
+}
+
+// MemoryRecords is an in-memory TXTRecords that expires records after a TTL.
+type MemoryRecords struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	records map[string][]txtRecord
+}
+
+type txtRecord struct {
+	value   string
+	expires time.Time
+}
+
+var _ TXTRecords = (*MemoryRecords)(nil)
+
+func NewMemoryRecords(ttl time.Duration) *MemoryRecords {
+	return &MemoryRecords{ttl: ttl, records: make(map[string][]txtRecord)}
+}
+
+func (m *MemoryRecords) AddTXT(ctx context.Context, name, value string) error {
+	name = canonicalName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := m.unexpired(name)
+	for i, rec := range records {
+		if rec.value == value {
+			records = append(records[:i], records[i+1:]...)
+			break
+		}
+	}
+	m.records[name] = append(records, txtRecord{value: value, expires: time.Now().Add(m.ttl)})
+	return nil
+}
+
+// LookupTXT returns the unexpired TXT values for name.
+func (m *MemoryRecords) LookupTXT(name string) []string {
+	name = canonicalName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := m.unexpired(name)
+	values := make([]string, len(records))
+	for i, rec := range records {
+		values[i] = rec.value
+	}
+	return values
+}
+
+// unexpired prunes and returns the records for name. Callers must hold mu.
+func (m *MemoryRecords) unexpired(name string) []txtRecord {
+	now := time.Now()
+	var records []txtRecord
+	for _, rec := range m.records[name] {
+		if now.Before(rec.expires) {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		delete(m.records, name)
+	} else {
+		m.records[name] = records
+	}
+	return records
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/lann/localcert"
+	"github.com/lann/localcert/internal/acmeutil"
+)
+
+const (
+	userAgent = "localcert-server/1.0"
+
+	maxRequestSize = 64 * 1024
+
+	problemMalformed    = "urn:ietf:params:acme:error:malformed"
+	problemUnauthorized = "urn:ietf:params:acme:error:unauthorized"
+	problemServer       = "urn:ietf:params:acme:error:serverInternal"
+)
+
+type Config struct {
+	// Zone is the parent zone of user domains, e.g. "user.localcert.dev".
+	Zone string
+
+	// ACMEDirectoryURL is the directory of the default ACME CA, for
+	// requests that don't name one. If empty, acme.LetsEncryptURL is used.
+	ACMEDirectoryURL string
+
+	// ACMEDirectoryURLs are the directories of other ACME CAs that requests
+	// may name, e.g. ZeroSSL or an internal step-ca. Signed requests are
+	// only forwarded to these CAs and the default.
+	ACMEDirectoryURLs []string
+
+	// Records publishes dns-01 challenge records.
+	Records TXTRecords
+
+	HTTPClient *http.Client
+}
+
+// Server implements the localcert API (/domain and /provision).
+type Server struct {
+	zone       string
+	records    TXTRecords
+	httpClient *http.Client
+	mux        *http.ServeMux
+
+	defaultDirectoryURL string
+	acmeClients         map[string]*acme.Client // by directory URL
+}
+
+func New(config Config) *Server {
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	s := &Server{
+		zone:                canonicalName(config.Zone),
+		records:             config.Records,
+		httpClient:          httpClient,
+		mux:                 http.NewServeMux(),
+		defaultDirectoryURL: config.ACMEDirectoryURL,
+		acmeClients:         make(map[string]*acme.Client),
+	}
+	if s.defaultDirectoryURL == "" {
+		s.defaultDirectoryURL = acme.LetsEncryptURL
+	}
+	for _, dirURL := range append([]string{s.defaultDirectoryURL}, config.ACMEDirectoryURLs...) {
+		s.acmeClients[dirURL] = &acme.Client{
+			DirectoryURL: dirURL,
+			HTTPClient:   httpClient,
+			UserAgent:    userAgent,
+		}
+	}
+	s.mux.HandleFunc("/domain", s.handleDomain)
+	s.mux.HandleFunc("/provision", s.handleProvision)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Domain returns the wildcard localcert domain for an ACME account URL.
+func (s *Server) Domain(accountURL string) string {
+	return "*." + s.baseDomain(accountURL)
+}
+
+func (s *Server) baseDomain(accountURL string) string {
+	sum := sha256.Sum256([]byte(accountURL))
+	id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:16])
+	return strings.ToLower(id) + "." + s.zone
+}
+
+func (s *Server) handleDomain(w http.ResponseWriter, r *http.Request) {
+	var req localcert.DomainRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	acmeClient := s.acmeClient(w, req.ACMEDirectoryURL)
+	if acmeClient == nil {
+		return
+	}
+
+	acctReq, err := acmeutil.ParseSignedRequest(req.AccountRequest)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid account request: %v", err))
+		return
+	}
+	if acctReq.JWK == nil {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, "account request must be signed with an embedded JWK")
+		return
+	}
+	if err := acctReq.Verify(acctReq.JWK.Key); err != nil {
+		writeProblem(w, http.StatusUnauthorized, problemUnauthorized, fmt.Sprintf("invalid account request signature: %v", err))
+		return
+	}
+
+	dir, err := acmeClient.Discover(r.Context())
+	if err != nil {
+		log.Printf("ACME discover error: %v", err)
+		writeProblem(w, http.StatusBadGateway, problemServer, "ACME directory unavailable")
+		return
+	}
+	if acctReq.URL != dir.RegURL {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("account request URL %q != %q", acctReq.URL, dir.RegURL))
+		return
+	}
+
+	resp, err := s.forward(r.Context(), acctReq)
+	if err != nil {
+		log.Printf("Account request error: %v", err)
+		writeProblem(w, http.StatusBadGateway, problemServer, "ACME account request failed")
+		return
+	}
+	defer resp.Body.Close()
+	if relayProblem(w, resp) {
+		return
+	}
+	accountURL := resp.Header.Get("Location")
+	if accountURL == "" {
+		writeProblem(w, http.StatusBadGateway, problemServer, "ACME account response missing Location")
+		return
+	}
+
+	writeJSON(w, localcert.DomainResult{Domain: s.Domain(accountURL)})
+}
+
+func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
+	var req localcert.ProvisionRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	acmeClient := s.acmeClient(w, req.ACMEDirectoryURL)
+	if acmeClient == nil {
+		return
+	}
+	if req.PublicKey == nil || !req.PublicKey.Valid() {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, "missing or invalid account public key")
+		return
+	}
+
+	authzReq, err := acmeutil.ParseSignedRequest(req.AuthorizationRequest)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid authorization request: %v", err))
+		return
+	}
+	if authzReq.KID == "" {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, "authorization request must be signed with a KID")
+		return
+	}
+	if err := authzReq.Verify(req.PublicKey.Key); err != nil {
+		writeProblem(w, http.StatusUnauthorized, problemUnauthorized, fmt.Sprintf("invalid authorization request signature: %v", err))
+		return
+	}
+	if !isACMEURL(acmeClient, authzReq.URL) {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("authorization URL %q is not on the ACME server", authzReq.URL))
+		return
+	}
+
+	resp, err := s.forward(r.Context(), authzReq)
+	if err != nil {
+		log.Printf("Authorization request error: %v", err)
+		writeProblem(w, http.StatusBadGateway, problemServer, "ACME authorization request failed")
+		return
+	}
+	defer resp.Body.Close()
+	if relayProblem(w, resp) {
+		return
+	}
+	var authz authorization
+	if err := json.NewDecoder(resp.Body).Decode(&authz); err != nil {
+		writeProblem(w, http.StatusBadGateway, problemServer, fmt.Sprintf("invalid ACME authorization: %v", err))
+		return
+	}
+
+	domain := s.baseDomain(authzReq.KID)
+	identifier := canonicalName(authz.Identifier.Value)
+	if authz.Identifier.Type != "dns" || (identifier != domain && !strings.HasSuffix(identifier, "."+domain)) {
+		writeProblem(w, http.StatusForbidden, problemUnauthorized, fmt.Sprintf("authorization identifier %q is not under %q", authz.Identifier.Value, domain))
+		return
+	}
+	chal := authz.challenge("dns-01")
+	if chal == nil {
+		writeProblem(w, http.StatusBadGateway, problemServer, "ACME authorization has no dns-01 challenge")
+		return
+	}
+
+	value, err := dns01Record(chal.Token, req.PublicKey.Key)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid account public key: %v", err))
+		return
+	}
+	name := "_acme-challenge." + identifier
+	if err := s.records.AddTXT(r.Context(), name, value); err != nil {
+		log.Printf("Error publishing TXT record %q: %v", name, err)
+		writeProblem(w, http.StatusInternalServerError, problemServer, "failed to publish challenge record")
+		return
+	}
+	log.Printf("Published dns-01 record for %q", authz.Identifier.Value)
+
+	writeJSON(w, localcert.ProvisionResult{
+		AuthorizationURL:        authzReq.URL,
+		ProvisionedChallengeURL: chal.URL,
+	})
+}
+
+// acmeClient returns the client for a request's ACME directory URL, or the
+// default CA if it is empty. If the CA isn't allowed it writes a problem
+// response and returns nil.
+func (s *Server) acmeClient(w http.ResponseWriter, dirURL string) *acme.Client {
+	if dirURL == "" {
+		dirURL = s.defaultDirectoryURL
+	}
+	acmeClient, ok := s.acmeClients[dirURL]
+	if !ok {
+		writeProblem(w, http.StatusForbidden, problemUnauthorized, fmt.Sprintf("ACME directory %q is not allowed by this server", dirURL))
+		return nil
+	}
+	return acmeClient
+}
+
+// isACMEURL reports whether rawURL is on the same origin as the ACME
+// directory, so signed requests can't be forwarded elsewhere.
+func isACMEURL(acmeClient *acme.Client, rawURL string) bool {
+	dir, err := url.Parse(acmeClient.DirectoryURL)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == dir.Scheme && u.Host == dir.Host
+}
+
+// forward sends a signed request to the ACME server it was signed for.
+func (s *Server) forward(ctx context.Context, signed *acmeutil.SignedRequest) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, signed.URL, bytes.NewReader(signed.Content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", acmeutil.RequestContentType)
+	req.Header.Set("User-Agent", userAgent)
+	return s.httpClient.Do(req)
+}
+
+type authorization struct {
+	Identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func (a *authorization) challenge(typ string) *challenge {
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == typ {
+			return &a.Challenges[i]
+		}
+	}
+	return nil
+}
+
+// dns01Record returns the TXT record value for a dns-01 challenge token.
+// See RFC 8555 section 8.4.
+func dns01Record(token string, publicKey interface{}) (string, error) {
+	jwk := jose.JSONWebKey{Key: publicKey}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	keyAuth := token + "." + base64.RawURLEncoding.EncodeToString(thumbprint)
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeProblem(w, http.StatusMethodNotAllowed, problemMalformed, "method must be POST")
+		return false
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(req)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemMalformed, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// relayProblem relays an ACME error response, reporting whether it did.
+func relayProblem(w http.ResponseWriter, resp *http.Response) bool {
+	statusErr := acmeutil.ErrorFromResponse(resp)
+	if statusErr == nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(statusErr.Code)
+	json.NewEncoder(w).Encode(statusErr.Body)
+	return true
+}
+
+func writeProblem(w http.ResponseWriter, code int, typ, detail string) {
+	statusErr := acmeutil.StatusError{Code: code}
+	statusErr.Body.Type = typ
+	statusErr.Body.Detail = detail
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statusErr.Body)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
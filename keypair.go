@@ -0,0 +1,103 @@
+package localcert
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// Cache key suffixes used by PutCertificate.
+const (
+	// CacheKeySuffixPrevious is appended to CacheKeyCertificate and
+	// CacheKeyCertificateKey for the pair replaced by PutCertificate.
+	CacheKeySuffixPrevious = ".prev"
+
+	cacheKeySuffixPending = ".next"
+)
+
+// PutCertificate stores a certificate chain and its new key in cache as a
+// pair, keeping the previous pair with CacheKeySuffixPrevious. Each pair's
+// key is staged before its certificate is written, so if PutCertificate is
+// interrupted, RecoverCertificate completes or discards the write and
+// neither pair stays mismatched.
+func PutCertificate(ctx context.Context, cache Cache, chain [][]byte, key crypto.Signer) error {
+	keyPEM, err := EncodePrivateKeyPEM(key)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+
+	prevCertPEM, err := cache.Get(ctx, CacheKeyCertificate)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		return fmt.Errorf("get %q: %w", CacheKeyCertificate, err)
+	}
+	prevKeyPEM, err := cache.Get(ctx, CacheKeyCertificateKey)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		return fmt.Errorf("get %q: %w", CacheKeyCertificateKey, err)
+	}
+	if prevCertPEM != nil && prevKeyPEM != nil {
+		err := putPair(ctx, cache, CacheKeyCertificate+CacheKeySuffixPrevious, CacheKeyCertificateKey+CacheKeySuffixPrevious, prevCertPEM, prevKeyPEM)
+		if err != nil {
+			return err
+		}
+	}
+
+	return putPair(ctx, cache, CacheKeyCertificate, CacheKeyCertificateKey, encodeChainPEM(chain), keyPEM)
+}
+
+// RecoverCertificate finishes an interrupted PutCertificate: a staged key
+// is stored if the certificate was already written for it, and otherwise
+// discarded. This applies to the current and the previous pair.
+func RecoverCertificate(ctx context.Context, cache Cache) error {
+	if err := recoverPair(ctx, cache, CacheKeyCertificate+CacheKeySuffixPrevious, CacheKeyCertificateKey+CacheKeySuffixPrevious); err != nil {
+		return err
+	}
+	return recoverPair(ctx, cache, CacheKeyCertificate, CacheKeyCertificateKey)
+}
+
+// putPair stores a certificate and key, staging the key first so that
+// recoverPair can finish or discard an interrupted write.
+func putPair(ctx context.Context, cache Cache, certName, keyName string, certPEM, keyPEM []byte) error {
+	pendingKey := keyName + cacheKeySuffixPending
+	if err := cache.Put(ctx, pendingKey, keyPEM); err != nil {
+		return fmt.Errorf("put %q: %w", pendingKey, err)
+	}
+	if err := cache.Put(ctx, certName, certPEM); err != nil {
+		return fmt.Errorf("put %q: %w", certName, err)
+	}
+	if err := cache.Put(ctx, keyName, keyPEM); err != nil {
+		return fmt.Errorf("put %q: %w", keyName, err)
+	}
+	if err := cache.Delete(ctx, pendingKey); err != nil {
+		return fmt.Errorf("delete %q: %w", pendingKey, err)
+	}
+	return nil
+}
+
+// recoverPair finishes an interrupted putPair.
+func recoverPair(ctx context.Context, cache Cache, certName, keyName string) error {
+	pendingKey := keyName + cacheKeySuffixPending
+	keyPEM, err := cache.Get(ctx, pendingKey)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get %q: %w", pendingKey, err)
+	}
+
+	certPEM, err := cache.Get(ctx, certName)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		return fmt.Errorf("get %q: %w", certName, err)
+	}
+	if err == nil {
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err == nil {
+			if err := cache.Put(ctx, keyName, keyPEM); err != nil {
+				return fmt.Errorf("put %q: %w", keyName, err)
+			}
+		}
+	}
+	if err := cache.Delete(ctx, pendingKey); err != nil {
+		return fmt.Errorf("delete %q: %w", pendingKey, err)
+	}
+	return nil
+}
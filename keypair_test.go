@@ -0,0 +1,105 @@
+package localcert
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// TestPutCertificateInterrupted interrupts PutCertificate at each write and
+// checks that after RecoverCertificate the current and previous
+// certificates still match their keys.
+func TestPutCertificateInterrupted(t *testing.T) {
+	ctx := context.Background()
+	chains := make([][][]byte, 3)
+	keys := make([]crypto.Signer, 3)
+	for i := range chains {
+		chains[i], keys[i] = newTestCertificate(t)
+	}
+
+	for writes := 0; ; writes++ {
+		var cache MemCache
+		for i := 0; i < 2; i++ {
+			if err := PutCertificate(ctx, &cache, chains[i], keys[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := PutCertificate(ctx, &failingCache{Cache: &cache, writes: writes}, chains[2], keys[2])
+		if err := RecoverCertificate(ctx, &cache); err != nil {
+			t.Fatalf("after %d writes: RecoverCertificate: %v", writes, err)
+		}
+		checkPair(t, &cache, writes, CacheKeyCertificate, CacheKeyCertificateKey)
+		checkPair(t, &cache, writes, CacheKeyCertificate+CacheKeySuffixPrevious, CacheKeyCertificateKey+CacheKeySuffixPrevious)
+		if err == nil {
+			break
+		}
+	}
+}
+
+func checkPair(t *testing.T, cache Cache, writes int, certName, keyName string) {
+	t.Helper()
+	certPEM, err := cache.Get(context.Background(), certName)
+	if err != nil {
+		t.Fatalf("after %d writes: get %q: %v", writes, certName, err)
+	}
+	keyPEM, err := cache.Get(context.Background(), keyName)
+	if err != nil {
+		t.Fatalf("after %d writes: get %q: %v", writes, keyName, err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Errorf("after %d writes: %s and %s don't match: %v", writes, certName, keyName, err)
+	}
+}
+
+// failingCache fails Put and Delete after the given number of writes, as if
+// the process had been killed.
+type failingCache struct {
+	Cache
+	writes int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (fc *failingCache) Put(ctx context.Context, key string, data []byte) error {
+	if fc.writes == 0 {
+		return errInterrupted
+	}
+	fc.writes--
+	return fc.Cache.Put(ctx, key, data)
+}
+
+func (fc *failingCache) Delete(ctx context.Context, key string) error {
+	if fc.writes == 0 {
+		return errInterrupted
+	}
+	fc.writes--
+	return fc.Cache.Delete(ctx, key)
+}
+
+func newTestCertificate(t *testing.T) ([][]byte, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{der}, key
+}
@@ -0,0 +1,84 @@
+package localcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+)
+
+// KeyType is a private key algorithm for certificate or account keys.
+type KeyType string
+
+const (
+	KeyTypeP256    KeyType = "p256"
+	KeyTypeP384    KeyType = "p384"
+	KeyTypeRSA2048 KeyType = "rsa2048"
+	KeyTypeRSA3072 KeyType = "rsa3072"
+	KeyTypeRSA4096 KeyType = "rsa4096"
+
+	// DefaultKeyType is used when no KeyType is configured.
+	DefaultKeyType = KeyTypeP256
+)
+
+// KeyTypes are the supported key types.
+var KeyTypes = []KeyType{KeyTypeP256, KeyTypeP384, KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096}
+
+// ParseKeyType parses a key type name, e.g. "p384" or "rsa2048".
+func ParseKeyType(name string) (KeyType, error) {
+	kt := KeyType(strings.ToLower(strings.ReplaceAll(name, "-", "")))
+	for _, known := range KeyTypes {
+		if kt == known {
+			return kt, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %q", name)
+}
+
+// GenerateKey generates a new private key of type kt, or DefaultKeyType if
+// kt is empty.
+func (kt KeyType) GenerateKey() (crypto.Signer, error) {
+	switch kt {
+	case "", KeyTypeP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", kt)
+}
+
+// KeyTypeOf returns the type of a public or private key, or "" if it isn't
+// one of KeyTypes.
+func KeyTypeOf(key interface{}) KeyType {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyTypeP256
+		case elliptic.P384():
+			return KeyTypeP384
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048
+		case 3072:
+			return KeyTypeRSA3072
+		case 4096:
+			return KeyTypeRSA4096
+		}
+	}
+	return ""
+}
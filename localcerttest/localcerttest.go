@@ -0,0 +1,293 @@
+// Package localcerttest starts TLS test servers at localcert names, e.g.
+// https://api.<id>.user.localcert.dev, with certificates that verify, and
+// HTTP clients that connect to them without DNS.
+//
+//	env := localcerttest.New(localcerttest.DefaultCertificate())
+//	defer env.Close()
+//	srv := env.NewServer("api", handler)
+//	resp, err := env.Client().Get(srv.URL)
+//
+// DefaultCertificate uses the certificate provisioned by the localcert CLI
+// if there is one, so tests run against real names on developer machines,
+// and otherwise mints one from a local test CA, so the same tests run
+// offline and on CI.
+package localcerttest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lann/localcert"
+)
+
+var errNoServer = errors.New("no test server")
+
+// DefaultTestDomain is the domain of certificates minted by TestCertificate
+// if none is given.
+const DefaultTestDomain = "*.localcert.test"
+
+// Certificate is a wildcard certificate for test servers.
+type Certificate struct {
+	// TLS is the certificate chain and key, with Leaf set.
+	TLS tls.Certificate
+
+	// Domain is the certificate's wildcard domain, e.g.
+	// "*.<id>.user.localcert.dev".
+	Domain string
+
+	// Roots verifies the certificate. If nil, the system roots are used.
+	Roots *x509.CertPool
+}
+
+// DataDirCertificate loads the certificate and key provisioned by the
+// localcert CLI in dataDir, or in the CLI's default data directory if
+// dataDir is empty. It returns an error if there is none or it has expired.
+func DataDirCertificate(dataDir string) (*Certificate, error) {
+	if dataDir == "" {
+		userConfigDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("user config dir: %w", err)
+		}
+		dataDir = filepath.Join(userConfigDir, "localcert")
+	}
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(dataDir, localcert.CacheKeyCertificate),
+		filepath.Join(dataDir, localcert.CacheKeyCertificateKey))
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate for %q expired %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if !strings.HasPrefix(cert.Leaf.Subject.CommonName, "*.") {
+		return nil, fmt.Errorf("certificate common name %q is not a wildcard domain", cert.Leaf.Subject.CommonName)
+	}
+	return &Certificate{TLS: cert, Domain: cert.Leaf.Subject.CommonName}, nil
+}
+
+// TestCertificate mints a certificate for the wildcard domain, e.g.
+// "*.localcert.test", from a new local test CA. If domain is empty,
+// DefaultTestDomain is used.
+func TestCertificate(domain string) (*Certificate, error) {
+	if domain == "" {
+		domain = DefaultTestDomain
+	}
+	if !strings.HasPrefix(domain, "*.") {
+		return nil, fmt.Errorf("domain %q is not a wildcard domain", domain)
+	}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(24 * time.Hour)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localcerttest root"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("create root: %w", err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &Certificate{
+		TLS:    tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: key, Leaf: leaf},
+		Domain: domain,
+		Roots:  roots,
+	}, nil
+}
+
+// DefaultCertificate returns DataDirCertificate for the CLI's default data
+// directory if it is usable, and otherwise a TestCertificate. It panics if
+// neither works.
+func DefaultCertificate() *Certificate {
+	if cert, err := DataDirCertificate(""); err == nil {
+		return cert
+	}
+	cert, err := TestCertificate("")
+	if err != nil {
+		panic(fmt.Sprintf("localcerttest: %v", err))
+	}
+	return cert
+}
+
+// Env runs TLS test servers with a Certificate and resolves their names for
+// its clients. An Env is safe for concurrent use.
+type Env struct {
+	cert *Certificate
+
+	mu      sync.Mutex
+	addrs   map[string]string // host name to listener address
+	servers []*Server
+}
+
+// New returns an Env serving cert. Callers should call Close when done.
+func New(cert *Certificate) *Env {
+	return &Env{cert: cert, addrs: make(map[string]string)}
+}
+
+// Certificate returns the Env's certificate.
+func (e *Env) Certificate() *Certificate {
+	return e.cert
+}
+
+// Host returns the host name for name under the certificate's domain, e.g.
+// "api.<id>.user.localcert.dev" for "api".
+func (e *Env) Host(name string) string {
+	return name + "." + strings.TrimPrefix(e.cert.Domain, "*.")
+}
+
+// Server is a TLS test server at a localcert name.
+type Server struct {
+	// URL is the server's base URL, e.g. "https://api.<domain>:43567".
+	URL string
+
+	// Host is the server's host name, e.g. "api.<domain>".
+	Host string
+
+	// Addr is the server's listener address, e.g. "127.0.0.1:43567".
+	Addr string
+
+	srv *httptest.Server
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// NewServer starts a TLS server for handler at Host(name). name must be a
+// single label, as the certificate is a wildcard.
+func (e *Env) NewServer(name string, handler http.Handler) *Server {
+	host := e.Host(name)
+	if name == "" || strings.Contains(name, ".") {
+		panic(fmt.Sprintf("localcerttest: name %q must be a single label", name))
+	}
+	if err := e.cert.TLS.Leaf.VerifyHostname(host); err != nil {
+		panic(fmt.Sprintf("localcerttest: %v", err))
+	}
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{e.cert.TLS}}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	addr := srv.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	s := &Server{
+		URL:  "https://" + net.JoinHostPort(host, port),
+		Host: host,
+		Addr: addr,
+		srv:  srv,
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.addrs[host] = addr
+	e.servers = append(e.servers, s)
+	return s
+}
+
+// Client returns an HTTP client that verifies servers with the
+// certificate's roots and connects to the Env's servers by name, without
+// DNS. Other names under the certificate's domain fail to connect; names
+// elsewhere are resolved as usual.
+func (e *Env) Client() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			addr, err := e.resolve(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: e.cert.Roots},
+		ForceAttemptHTTP2: true,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// resolve maps the address of an Env server to its listener address.
+func (e *Env) resolve(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if listenAddr, ok := e.addrs[host]; ok {
+		return listenAddr, nil
+	}
+	if strings.HasSuffix(host, strings.TrimPrefix(e.cert.Domain, "*")) {
+		// Don't send test requests to whatever the name really resolves to.
+		return "", fmt.Errorf("localcerttest: %w for %q", errNoServer, host)
+	}
+	return addr, nil
+}
+
+// Close shuts down the Env's servers.
+func (e *Env) Close() {
+	e.mu.Lock()
+	servers := e.servers
+	e.servers = nil
+	e.addrs = make(map[string]string)
+	e.mu.Unlock()
+	for _, s := range servers {
+		s.Close()
+	}
+}
@@ -0,0 +1,464 @@
+package localcert
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	defaultRenewBefore = 30 * 24 * time.Hour
+	renewTimeout       = 10 * time.Minute
+	renewRetryInterval = 10 * time.Minute
+
+	// renewalInfoInterval is how often renewal information is checked if
+	// the ACME server doesn't say.
+	renewalInfoInterval = 6 * time.Hour
+)
+
+// AcceptTOS is a Manager.Prompt function that always accepts the terms of
+// service.
+func AcceptTOS(tosURL string) bool { return true }
+
+// Manager obtains a localcert wildcard certificate on first use and renews it
+// in the background, in the style of autocert.Manager.
+//
+//	m := &localcert.Manager{Prompt: localcert.AcceptTOS}
+//	srv := &http.Server{TLSConfig: m.TLSConfig()}
+//	srv.ListenAndServeTLS("", "")
+//
+// A Manager is safe for concurrent use.
+type Manager struct {
+	// Config configures the underlying Client. If Config.ACMEPrivateKey is
+	// nil, the account is loaded from Cache or a new account key is
+	// generated. Without a Cache, a new account (and domain) is used for each
+	// Manager.
+	Config Config
+
+	// Cache optionally stores the ACME account, certificate and key, using
+	// the same keys as the localcert CLI.
+	Cache Cache
+
+	// Prompt is called with the ACME provider's terms of service URL when
+	// registering a new account. It must return true to accept the terms.
+	// If nil, the terms are not accepted and registration fails.
+	Prompt func(tosURL string) bool
+
+	// RenewBefore is how long before expiration the certificate is renewed.
+	// If zero, certificates are renewed within the ACME server's suggested
+	// renewal window (ARI), checked periodically, or else 30 days before
+	// expiration.
+	RenewBefore time.Duration
+
+	// Key is the certificate private key. If nil, the key is loaded from
+	// Cache or a key of KeyType is generated.
+	Key crypto.Signer
+
+	// KeyType is the type of generated certificate keys. If empty,
+	// DefaultKeyType is used.
+	KeyType KeyType
+
+	// AccountKeyType is the type of generated ACME account keys. If empty,
+	// DefaultKeyType is used.
+	AccountKeyType KeyType
+
+	// RotateKey generates a new certificate key for each certificate
+	// instead of reusing one. It is ignored if Key is set. The new key and
+	// certificate are cached with PutCertificate.
+	RotateKey bool
+
+	clientMu sync.Mutex
+	client   *Client
+	certKey  crypto.Signer
+	account  *ACMEAccount
+
+	// obtainMu serializes certificate requests.
+	obtainMu sync.Mutex
+
+	certMu       sync.RWMutex
+	cert         *tls.Certificate
+	renewalTimer *time.Timer
+}
+
+// TLSConfig returns a tls.Config that gets certificates from the Manager.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. It obtains a
+// certificate on first use, blocking the handshake until it is issued.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+	if hello.Context() != nil {
+		ctx = hello.Context()
+	}
+	cert, err := m.certificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(hello.ServerName, ".")
+	if name != "" {
+		if err := cert.Leaf.VerifyHostname(name); err != nil {
+			return nil, fmt.Errorf("localcert: no certificate for %q", name)
+		}
+	}
+	return cert, nil
+}
+
+// Domain returns the wildcard domain of the Manager's certificate, e.g.
+// "*.fsbli4oliukyh3ydjuzx7q2tdq.user.localcert.dev", obtaining the
+// certificate if necessary.
+func (m *Manager) Domain(ctx context.Context) (string, error) {
+	cert, err := m.certificate(ctx)
+	if err != nil {
+		return "", err
+	}
+	return cert.Leaf.Subject.CommonName, nil
+}
+
+func (m *Manager) certificate(ctx context.Context) (*tls.Certificate, error) {
+	if cert := m.currentCert(); cert != nil {
+		return cert, nil
+	}
+
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+	// Another caller may have obtained a certificate while we waited
+	if cert := m.currentCert(); cert != nil {
+		return cert, nil
+	}
+	if cert, err := m.loadCachedCert(ctx); err != nil {
+		log.Printf("localcert: ignoring cached certificate: %v", err)
+	} else if cert != nil {
+		return cert, nil
+	}
+	return m.obtain(ctx)
+}
+
+// loadCachedCert loads the certificate from Cache, if any, and schedules its
+// renewal. Callers must hold obtainMu.
+func (m *Manager) loadCachedCert(ctx context.Context) (*tls.Certificate, error) {
+	if m.Cache == nil {
+		return nil, nil
+	}
+	_, certKey, err := m.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := m.Cache.Get(ctx, CacheKeyCertificate)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodePrivateKeyPEM(certKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, nil
+	}
+
+	m.certMu.Lock()
+	m.cert = &cert
+	m.certMu.Unlock()
+	// Check renewal info in the background rather than delaying the
+	// handshake.
+	m.scheduleRenewal(0)
+	return &cert, nil
+}
+
+// currentCert returns the cached certificate if it hasn't expired.
+func (m *Manager) currentCert() *tls.Certificate {
+	m.certMu.RLock()
+	defer m.certMu.RUnlock()
+	if m.cert == nil || time.Now().After(m.cert.Leaf.NotAfter) {
+		return nil
+	}
+	return m.cert
+}
+
+// obtain requests a new certificate, caches it and schedules its renewal.
+// Callers must hold obtainMu.
+func (m *Manager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, certKey, err := m.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rotate := m.RotateKey && m.Key == nil
+	if rotate {
+		certKey, err = m.KeyType.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("localcert: generate certificate key: %w", err)
+		}
+	}
+
+	if err := m.register(ctx, client); err != nil {
+		return nil, err
+	}
+
+	domain, err := client.GetDomain(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("localcert: get domain: %w", err)
+	}
+	var existing *x509.Certificate
+	m.certMu.RLock()
+	if m.cert != nil {
+		existing = m.cert.Leaf
+	}
+	m.certMu.RUnlock()
+	order, err := client.RenewDomain(ctx, existing, domain)
+	if err != nil {
+		return nil, fmt.Errorf("localcert: provision domain: %w", err)
+	}
+	chain, err := client.GetCertificate(ctx, order, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("localcert: get certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("localcert: parse certificate: %w", err)
+	}
+
+	cert := &tls.Certificate{Certificate: chain, PrivateKey: certKey, Leaf: leaf}
+	if rotate {
+		m.clientMu.Lock()
+		m.certKey = certKey
+		m.clientMu.Unlock()
+	}
+	if m.Cache != nil {
+		var err error
+		if rotate {
+			err = PutCertificate(ctx, m.Cache, chain, certKey)
+		} else {
+			err = m.Cache.Put(ctx, CacheKeyCertificate, encodeChainPEM(chain))
+		}
+		if err != nil {
+			log.Printf("localcert: caching certificate: %v", err)
+		}
+	}
+	m.certMu.Lock()
+	m.cert = cert
+	m.certMu.Unlock()
+	m.scheduleRenewal(m.nextRenewalCheck(ctx, client, leaf))
+	return cert, nil
+}
+
+func (m *Manager) getClient(ctx context.Context) (*Client, crypto.Signer, error) {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if m.client != nil {
+		return m.client, m.certKey, nil
+	}
+
+	config := m.Config
+	account := &ACMEAccount{
+		DirectoryURL:           config.ACMEDirectoryURL,
+		ExternalAccountBinding: config.ExternalAccountBinding,
+	}
+	if config.ACMEPrivateKey != nil {
+		account.PrivateKey = &jose.JSONWebKey{Key: config.ACMEPrivateKey}
+	} else if cached, err := m.cacheGet(ctx, CacheKeyACMEAccount); err != nil {
+		return nil, nil, err
+	} else if cached != nil {
+		account, err = ParseACMEAccount(cached)
+		if err != nil {
+			return nil, nil, fmt.Errorf("localcert: decode cached account: %w", err)
+		}
+		if config.ACMEDirectoryURL != "" && config.ACMEDirectoryURL != account.DirectoryURL {
+			return nil, nil, fmt.Errorf("localcert: cached account directory URL %q != %q", account.DirectoryURL, config.ACMEDirectoryURL)
+		}
+		config.ACMEDirectoryURL = account.DirectoryURL
+		config.ACMEPrivateKey = account.Signer()
+		if config.ExternalAccountBinding == nil {
+			config.ExternalAccountBinding = account.ExternalAccountBinding
+		}
+	} else {
+		key, err := m.AccountKeyType.GenerateKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("localcert: generate account key: %w", err)
+		}
+		config.ACMEPrivateKey = key
+		account.PrivateKey = &jose.JSONWebKey{Key: key}
+	}
+
+	certKey := m.Key
+	if certKey == nil && m.Cache != nil {
+		if err := RecoverCertificate(ctx, m.Cache); err != nil {
+			return nil, nil, fmt.Errorf("localcert: recover certificate: %w", err)
+		}
+	}
+	if certKey == nil {
+		if cached, err := m.cacheGet(ctx, CacheKeyCertificateKey); err != nil {
+			return nil, nil, err
+		} else if cached != nil {
+			var legacy bool
+			certKey, legacy, err = DecodePrivateKeyPEM(cached)
+			if err != nil {
+				return nil, nil, fmt.Errorf("localcert: decode cached certificate key: %w", err)
+			}
+			if legacy {
+				// Rewrite keys from earlier versions so other tools can read them.
+				keyPEM, err := EncodePrivateKeyPEM(certKey)
+				if err != nil {
+					return nil, nil, fmt.Errorf("localcert: encode certificate key: %w", err)
+				}
+				if err := m.cachePut(ctx, CacheKeyCertificateKey, keyPEM); err != nil {
+					return nil, nil, err
+				}
+			}
+		} else {
+			key, err := m.KeyType.GenerateKey()
+			if err != nil {
+				return nil, nil, fmt.Errorf("localcert: generate certificate key: %w", err)
+			}
+			keyPEM, err := EncodePrivateKeyPEM(key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("localcert: encode certificate key: %w", err)
+			}
+			if err := m.cachePut(ctx, CacheKeyCertificateKey, keyPEM); err != nil {
+				return nil, nil, err
+			}
+			certKey = key
+		}
+	}
+
+	m.client = config.Client()
+	m.certKey = certKey
+	m.account = account
+	return m.client, m.certKey, nil
+}
+
+// cacheGet returns nil data on a cache miss or if there is no Cache.
+func (m *Manager) cacheGet(ctx context.Context, key string) ([]byte, error) {
+	if m.Cache == nil {
+		return nil, nil
+	}
+	data, err := m.Cache.Get(ctx, key)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("localcert: cache get %q: %w", key, err)
+	}
+	return data, nil
+}
+
+func (m *Manager) cachePut(ctx context.Context, key string, data []byte) error {
+	if m.Cache == nil {
+		return nil
+	}
+	if err := m.Cache.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("localcert: cache put %q: %w", key, err)
+	}
+	return nil
+}
+
+func (m *Manager) register(ctx context.Context, client *Client) error {
+	for {
+		account, err := client.EnsureRegistration(ctx, m.account.AcceptedTerms, m.account.PrivateKey.KeyID)
+		if termsErr := (TermsNotAcceptedError{}); errors.As(err, &termsErr) && m.account.AcceptedTerms != termsErr.URI {
+			if m.Prompt == nil || !m.Prompt(termsErr.URI) {
+				return fmt.Errorf("localcert: terms of service %q not accepted", termsErr.URI)
+			}
+			m.account.AcceptedTerms = termsErr.URI
+			continue
+		} else if err != nil {
+			return fmt.Errorf("localcert: registration: %w", err)
+		}
+		if m.account.PrivateKey.KeyID != account.URI {
+			m.account.PrivateKey.KeyID = account.URI
+			data, err := m.account.Marshal()
+			if err != nil {
+				return fmt.Errorf("localcert: encode account: %w", err)
+			}
+			if err := m.cachePut(ctx, CacheKeyACMEAccount, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// nextRenewalCheck returns how long until leaf should be renewed or its
+// renewal info checked again.
+func (m *Manager) nextRenewalCheck(ctx context.Context, client *Client, leaf *x509.Certificate) time.Duration {
+	if m.RenewBefore > 0 {
+		return time.Until(leaf.NotAfter.Add(-m.RenewBefore))
+	}
+	info, err := client.GetRenewalInfo(ctx, leaf)
+	if errors.Is(err, ErrRenewalInfoUnsupported) {
+		return time.Until(leaf.NotAfter.Add(-defaultRenewBefore))
+	} else if err != nil {
+		log.Printf("localcert: renewal info: %v", err)
+		after := time.Until(leaf.NotAfter.Add(-defaultRenewBefore))
+		if after > renewalInfoInterval {
+			after = renewalInfoInterval
+		}
+		return after
+	}
+	if info.ExplanationURL != "" {
+		log.Printf("localcert: suggested renewal window %s to %s: %s", info.SuggestedWindow.Start, info.SuggestedWindow.End, info.ExplanationURL)
+	}
+	after := time.Until(info.RenewalTime())
+	check := info.RetryAfter
+	if check <= 0 {
+		check = renewalInfoInterval
+	}
+	if check < after {
+		after = check
+	}
+	return after
+}
+
+func (m *Manager) scheduleRenewal(after time.Duration) {
+	m.certMu.Lock()
+	defer m.certMu.Unlock()
+	if m.renewalTimer != nil {
+		m.renewalTimer.Stop()
+	}
+	m.renewalTimer = time.AfterFunc(after, m.renew)
+}
+
+func (m *Manager) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+	defer cancel()
+
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+	if cert := m.currentCert(); cert != nil {
+		client, _, err := m.getClient(ctx)
+		if err != nil {
+			log.Printf("localcert: renewal failed; retrying in %s: %v", renewRetryInterval, err)
+			m.scheduleRenewal(renewRetryInterval)
+			return
+		}
+		if after := m.nextRenewalCheck(ctx, client, cert.Leaf); after > 0 {
+			m.scheduleRenewal(after)
+			return
+		}
+	}
+	if _, err := m.obtain(ctx); err != nil {
+		log.Printf("localcert: renewal failed; retrying in %s: %v", renewRetryInterval, err)
+		m.scheduleRenewal(renewRetryInterval)
+	}
+}
@@ -0,0 +1,74 @@
+package localcert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	certificatePEMType   = "CERTIFICATE"
+	privateKeyPEMType    = "PRIVATE KEY"
+	ecPrivateKeyPEMType  = "EC PRIVATE KEY"
+	rsaPrivateKeyPEMType = "RSA PRIVATE KEY"
+	ecParametersPEMType  = "EC PARAMETERS"
+)
+
+func encodeChainPEM(chain [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&buf, &pem.Block{Type: certificatePEMType, Bytes: der})
+	}
+	return buf.Bytes()
+}
+
+// EncodePrivateKeyPEM encodes key as a PKCS#8 ("PRIVATE KEY") PEM block.
+func EncodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: der}), nil
+}
+
+// DecodePrivateKeyPEM decodes a PKCS#8 ("PRIVATE KEY"), SEC1 ("EC PRIVATE
+// KEY") or PKCS#1 ("RSA PRIVATE KEY") PEM private key, skipping a leading
+// "EC PARAMETERS" block. It reports whether the key was in the legacy
+// format written by earlier versions of localcert, SEC1 mislabeled as
+// PKCS#8, which should be rewritten with EncodePrivateKeyPEM.
+func DecodePrivateKeyPEM(data []byte) (key crypto.Signer, legacy bool, err error) {
+	block, rest := pem.Decode(data)
+	if block != nil && block.Type == ecParametersPEMType {
+		// e.g. from `openssl ecparam -genkey`
+		block, _ = pem.Decode(rest)
+	}
+	if block == nil {
+		return nil, false, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case privateKeyPEMType:
+		pkcs8Key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if ecKey, ecErr := x509.ParseECPrivateKey(block.Bytes); ecErr == nil {
+				return ecKey, true, nil
+			}
+			return nil, false, err
+		}
+		signer, ok := pkcs8Key.(crypto.Signer)
+		if !ok {
+			return nil, false, fmt.Errorf("unsupported private key type %T", pkcs8Key)
+		}
+		return signer, false, nil
+	case ecPrivateKeyPEMType:
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case rsaPrivateKeyPEMType:
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, false, fmt.Errorf("unexpected PEM type %q", block.Type)
+	}
+	return key, false, err
+}
@@ -0,0 +1,73 @@
+package localcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestDecodePrivateKeyPEM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := EncodePrivateKeyPEM(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(pemType string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	}
+	ecParams := encode(ecParametersPEMType, []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07})
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		keyType KeyType
+		legacy  bool
+		wantErr bool
+	}{
+		{name: "pkcs8", data: pkcs8, keyType: KeyTypeP256},
+		{name: "sec1", data: encode(ecPrivateKeyPEMType, sec1), keyType: KeyTypeP256},
+		{name: "sec1 with parameters", data: append(ecParams, encode(ecPrivateKeyPEMType, sec1)...), keyType: KeyTypeP256},
+		{name: "pkcs1", data: encode(rsaPrivateKeyPEMType, x509.MarshalPKCS1PrivateKey(rsaKey)), keyType: KeyTypeRSA2048},
+		{name: "legacy sec1 as pkcs8", data: encode(privateKeyPEMType, sec1), keyType: KeyTypeP256, legacy: true},
+		{name: "pkcs8 as sec1", data: encode(ecPrivateKeyPEMType, pkcs8DER), wantErr: true},
+		{name: "certificate", data: encode(certificatePEMType, sec1), wantErr: true},
+		{name: "not pem", data: sec1, wantErr: true},
+	} {
+		key, legacy, err := DecodePrivateKeyPEM(tc.data)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if kt := KeyTypeOf(key); kt != tc.keyType {
+			t.Errorf("%s: key type = %s, want %s", tc.name, kt, tc.keyType)
+		}
+		if legacy != tc.legacy {
+			t.Errorf("%s: legacy = %v, want %v", tc.name, legacy, tc.legacy)
+		}
+	}
+}
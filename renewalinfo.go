@@ -0,0 +1,225 @@
+package localcert
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/lann/localcert/internal/acmeutil"
+)
+
+// ErrRenewalInfoUnsupported is returned by GetRenewalInfo if the ACME server
+// doesn't support ACME Renewal Information (ARI).
+var ErrRenewalInfoUnsupported = errors.New("localcert: ACME server does not support renewal information")
+
+// RenewalInfo is the ACME server's renewal information for a certificate.
+// See RFC 9773.
+type RenewalInfo struct {
+	// SuggestedWindow is when the certificate should be renewed.
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+
+	// ExplanationURL optionally explains the suggested window, e.g. for a
+	// revocation incident.
+	ExplanationURL string `json:"explanationURL,omitempty"`
+
+	// RetryAfter is how long to wait before checking for new renewal
+	// information, from the Retry-After header. It is zero if not given.
+	RetryAfter time.Duration `json:"-"`
+
+	// certID is the ARI identifier of the certificate, for RenewalTime.
+	certID string
+}
+
+// RenewalWindow is a suggested certificate renewal window.
+type RenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RenewalTime returns a time within the suggested window. RFC 9773
+// recommends a random time, to spread renewals out; it is derived from the
+// certificate ID and the window, so that it differs between certificates
+// but stays the same for a certificate until the window changes.
+func (info *RenewalInfo) RenewalTime() time.Time {
+	w := info.SuggestedWindow
+	if !w.End.After(w.Start) {
+		return w.Start
+	}
+	sum := sha256.Sum256([]byte(info.certID + "|" + w.Start.UTC().Format(time.RFC3339Nano) + "|" + w.End.UTC().Format(time.RFC3339Nano)))
+	offset := binary.BigEndian.Uint64(sum[:8]) % uint64(w.End.Sub(w.Start))
+	return w.Start.Add(time.Duration(offset))
+}
+
+// CertID returns the ARI certificate identifier for cert: its authority key
+// identifier and serial number, base64url-encoded.
+func CertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("localcert: certificate has no authority key identifier")
+	}
+	// The serial is DER-encoded without the tag and length, so positive
+	// serials with the high bit set get a leading zero.
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// GetRenewalInfo fetches the ACME server's renewal information for cert. It
+// returns ErrRenewalInfoUnsupported if the server doesn't provide any.
+func (c *Client) GetRenewalInfo(ctx context.Context, cert *x509.Certificate) (*RenewalInfo, error) {
+	certID, err := CertID(cert)
+	if err != nil {
+		return nil, err
+	}
+	renewalInfoURL, err := c.renewalInfoURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(renewalInfoURL, "/")+"/"+certID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.acmeDo(req)
+	if err != nil {
+		return nil, fmt.Errorf("renewal info: %w", err)
+	}
+	defer resp.Body.Close()
+	if statusErr := acmeutil.ErrorFromResponse(resp); statusErr != nil {
+		return nil, fmt.Errorf("renewal info: %w", acmeError(statusErr))
+	}
+
+	var info RenewalInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("renewal info: json decode: %w", err)
+	}
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("renewal info: invalid suggested window %v - %v", info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	}
+	info.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+	info.certID = certID
+	return &info, nil
+}
+
+// renewalInfoURL returns the directory's renewalInfo URL, which
+// acme.Directory doesn't include.
+func (c *Client) renewalInfoURL(ctx context.Context) (string, error) {
+	c.directoryMu.Lock()
+	defer c.directoryMu.Unlock()
+	if c.renewalInfo != nil {
+		if *c.renewalInfo == "" {
+			return "", ErrRenewalInfoUnsupported
+		}
+		return *c.renewalInfo, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.acmeDo(req)
+	if err != nil {
+		return "", fmt.Errorf("discover: %w", err)
+	}
+	defer resp.Body.Close()
+	if statusErr := acmeutil.ErrorFromResponse(resp); statusErr != nil {
+		return "", fmt.Errorf("discover: %w", acmeError(statusErr))
+	}
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return "", fmt.Errorf("discover: json decode: %w", err)
+	}
+	c.renewalInfo = &dir.RenewalInfo
+	if dir.RenewalInfo == "" {
+		return "", ErrRenewalInfoUnsupported
+	}
+	return dir.RenewalInfo, nil
+}
+
+// newOrderReplacing creates an order for ids with the ARI "replaces" field
+// set to certID.
+func (c *Client) newOrderReplacing(ctx context.Context, ids []acme.AuthzID, certID string) (*acme.Order, error) {
+	dir, err := c.acmeClient.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+	accountURL, err := c.getAccountURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+		Replaces    string       `json:"replaces"`
+	}
+	for _, id := range ids {
+		payload.Identifiers = append(payload.Identifiers, identifier{id.Type, id.Value})
+	}
+	payload.Replaces = certID
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("json encode: %w", err)
+	}
+	body, err := c.signer(dir, accountURL).Sign(ctx, dir.OrderURL, payloadBytes)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	resp, err := c.acmePost(ctx, dir.OrderURL, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Status         string       `json:"status"`
+		Identifiers    []identifier `json:"identifiers"`
+		Authorizations []string     `json:"authorizations"`
+		Finalize       string       `json:"finalize"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("json decode: %w", err)
+	}
+	order := &acme.Order{
+		URI:         resp.Header.Get("Location"),
+		Status:      res.Status,
+		AuthzURLs:   res.Authorizations,
+		FinalizeURL: res.Finalize,
+	}
+	for _, id := range res.Identifiers {
+		order.Identifiers = append(order.Identifiers, acme.AuthzID{Type: id.Type, Value: id.Value})
+	}
+	return order, nil
+}
+
+// retryAfter parses a Retry-After header value in seconds or as an HTTP
+// date, returning zero if it is missing or invalid.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,32 @@
+package localcert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewalTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := RenewalWindow{Start: start, End: start.Add(48 * time.Hour)}
+	info := &RenewalInfo{SuggestedWindow: window, certID: "aaaa.AQ"}
+
+	renewAt := info.RenewalTime()
+	if renewAt.Before(window.Start) || !renewAt.Before(window.End) {
+		t.Fatalf("renewal time %s outside window %s to %s", renewAt, window.Start, window.End)
+	}
+	for i := 0; i < 10; i++ {
+		if again := info.RenewalTime(); !again.Equal(renewAt) {
+			t.Fatalf("renewal time changed from %s to %s", renewAt, again)
+		}
+	}
+
+	other := &RenewalInfo{SuggestedWindow: window, certID: "aaaa.Ag"}
+	if other.RenewalTime().Equal(renewAt) {
+		t.Errorf("certificates %q and %q have the same renewal time %s", info.certID, other.certID, renewAt)
+	}
+
+	empty := &RenewalInfo{SuggestedWindow: RenewalWindow{Start: start, End: start}}
+	if got := empty.RenewalTime(); !got.Equal(start) {
+		t.Errorf("renewal time for empty window = %s, want %s", got, start)
+	}
+}